@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"multichannel/cmd/logging"
 	"net/http"
 	"time"
 )
@@ -14,12 +15,14 @@ type Client struct {
 	HTTPClient *http.Client
 }
 
-// NewClient creates a new Ollama API client.
+// NewClient creates a new Ollama API client. API calls are logged at debug
+// level, failures at warn level.
 func NewClient(baseURL string) *Client {
 	return &Client{
 		BaseURL: baseURL,
 		HTTPClient: &http.Client{
-			Timeout: 300 * time.Second,
+			Timeout:   300 * time.Second,
+			Transport: &logging.Transport{},
 		},
 	}
 }
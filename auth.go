@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"multichannel/cmd/typedefs"
+	"net"
+	"os"
+	"time"
+)
+
+// authPolicy decides which workers may register which paths. When nil, as
+// without -auth-policy, any worker may register any path.
+var authPolicy *AuthPolicy
+
+// AuthPolicy is loaded from a JSON file such as
+//
+//	{
+//	  "credentials": [
+//	    {"name": "ollama-box", "token": "…", "paths": ["/ollama", "/ollama/*"]},
+//	    {"name": "demo", "secret": "…", "paths": ["GET /stocks/*", "/weather"]}
+//	  ]
+//	}
+//
+// Each credential is either a pre-shared token or an HMAC secret used to
+// answer the WELCOME challenge, and may claim the paths covered by its
+// patterns (see typedefs.Route.Covers).
+type AuthPolicy struct {
+	Credentials []*Credential `json:"credentials"`
+}
+
+// Credential is an entry of the auth policy. It is proven with a token, an
+// HMAC secret, or a TLS client certificate whose subject common name is
+// Subject.
+type Credential struct {
+	Name    string   `json:"name"`
+	Token   string   `json:"token,omitempty"`
+	Secret  string   `json:"secret,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+	Paths   []string `json:"paths"`
+	routes  []*typedefs.Route
+}
+
+// handshake is what the gateway knows about a worker connection before REG.
+// It is only used by the connection's read loop.
+type handshake struct {
+	challenge  string // nonce sent in WELCOME
+	subject    string // common name of the verified client certificate
+	registered bool   // a REG on the connection was accepted
+}
+
+// LoadAuthPolicy reads and validates a policy file.
+func LoadAuthPolicy(path string) (*AuthPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy AuthPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, cred := range policy.Credentials {
+		switch {
+		case cred.Name == "":
+			return nil, fmt.Errorf("%s: credential %d has no name", path, i)
+		case names[cred.Name]:
+			return nil, fmt.Errorf("%s: duplicate credential %q", path, cred.Name)
+		case countSet(cred.Token, cred.Secret, cred.Subject) != 1:
+			return nil, fmt.Errorf("%s: credential %q needs exactly one of token, secret and subject", path, cred.Name)
+		}
+		names[cred.Name] = true
+		for _, pattern := range cred.Paths {
+			route, err := typedefs.ParseRoute(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: credential %q: %w", path, cred.Name, err)
+			}
+			cred.routes = append(cred.routes, route)
+		}
+	}
+	return &policy, nil
+}
+
+func countSet(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
+
+var errBadCredential = errors.New("invalid credential")
+
+// Authenticate finds the credential auth proves. Tokens are matched against
+// every token credential, or only the one named by KeyID; signatures must
+// name their credential and sign challenge and clientId. Without auth, the
+// worker's certificate subject selects a subject credential.
+func (p *AuthPolicy) Authenticate(auth *typedefs.Auth, hs *handshake, clientId string) (*Credential, error) {
+	if auth == nil || (auth.Token == "" && auth.Signature == "") {
+		if hs.subject == "" {
+			return nil, errors.New("no credential presented")
+		}
+		for _, cred := range p.Credentials {
+			if cred.Subject != "" && cred.Subject == hs.subject {
+				return cred, nil
+			}
+		}
+		return nil, fmt.Errorf("no credential for certificate subject %q", hs.subject)
+	}
+	for _, cred := range p.Credentials {
+		if auth.KeyID != "" && auth.KeyID != cred.Name {
+			continue
+		}
+		switch {
+		case auth.Token != "" && cred.Token != "":
+			if subtle.ConstantTimeCompare([]byte(auth.Token), []byte(cred.Token)) == 1 {
+				return cred, nil
+			}
+		case auth.Signature != "" && cred.Secret != "" && auth.KeyID != "":
+			want := typedefs.SignChallenge([]byte(cred.Secret), hs.challenge, clientId)
+			if hmac.Equal([]byte(auth.Signature), []byte(want)) {
+				return cred, nil
+			}
+		}
+	}
+	return nil, errBadCredential
+}
+
+// Denied returns the patterns in paths the credential may not claim.
+func (c *Credential) Denied(paths []string) []string {
+	var denied []string
+	for _, pattern := range paths {
+		route, err := typedefs.ParseRoute(pattern)
+		if err != nil || !c.allows(route) {
+			denied = append(denied, pattern)
+		}
+	}
+	return denied
+}
+
+func (c *Credential) allows(route *typedefs.Route) bool {
+	for _, granted := range c.routes {
+		if granted.Covers(route) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrClientIdInUse is returned by TCPManager.Register when a worker holding
+// another credential is registered with the same client ID.
+var ErrClientIdInUse = errors.New("client_id is registered with another credential")
+
+// authorizeRegistration checks a REG frame against the auth policy and
+// returns the identity the worker registers with: the name of its policy
+// credential, or without a policy its certificate subject, if any. Without a
+// policy every registration is allowed.
+func authorizeRegistration(msg *typedefs.TcpMessage, hs *handshake, clientId string, paths []interface{}) (string, *typedefs.Rejection) {
+	if authPolicy == nil {
+		if hs.subject != "" {
+			return "cert:" + hs.subject, nil
+		}
+		return "", nil
+	}
+	var reg struct {
+		Auth *typedefs.Auth `json:"auth"`
+	}
+	json.Unmarshal(msg.Msg, &reg)
+	cred, err := authPolicy.Authenticate(reg.Auth, hs, clientId)
+	if err != nil {
+		return "", &typedefs.Rejection{Code: typedefs.RejectUnauthenticated, Reason: err.Error()}
+	}
+
+	patterns := make([]string, 0, len(paths))
+	for _, path := range paths {
+		pattern, _ := path.(string)
+		patterns = append(patterns, pattern)
+	}
+	if denied := cred.Denied(patterns); len(denied) > 0 {
+		return "", &typedefs.Rejection{
+			Code:   typedefs.RejectForbiddenPath,
+			Reason: fmt.Sprintf("credential %q may not claim %v", cred.Name, denied),
+			Paths:  denied,
+		}
+	}
+	return cred.Name, nil
+}
+
+// Reject sends a REG_REJECTED frame and waits for it to be written, so the
+// worker learns why before its connection is closed.
+func (m *TCPManager) Reject(conn *net.Conn, rejection *typedefs.Rejection) {
+	registrationsTotal.With(rejection.Code).Inc()
+	payload, _ := json.Marshal(rejection)
+	frame := typedefs.TcpMessage{Sub: "REG_REJECTED", Msg: payload}
+	if err := m.Writer(conn).WriteMessage(&frame); err != nil {
+		connLogger(conn).Warn("Sending registration rejection failed", "error", err)
+		return
+	}
+	m.mu.RLock()
+	state, ok := m.conns[conn]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+	timeout := m.WriteTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if err := state.out.Flush(timeout); err != nil {
+		connLogger(conn).Warn("Sending registration rejection failed", "error", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `{
+  "credentials": [
+    {"name": "ollama-box", "token": "s3cret-token", "paths": ["/ollama", "/ollama/*"]},
+    {"name": "demo", "secret": "hmac-secret", "paths": ["GET /stocks/*", "/weather"]},
+    {"name": "edge", "subject": "edge.example.com", "paths": ["/edge/*"]}
+  ]
+}`
+
+func loadTestPolicy(t *testing.T, policy string) (*AuthPolicy, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadAuthPolicy(path)
+}
+
+func TestLoadAuthPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{"valid", testPolicy, false},
+		{"not json", `credentials: []`, true},
+		{"no name", `{"credentials": [{"token": "t", "paths": ["/a"]}]}`, true},
+		{"duplicate name", `{"credentials": [{"name": "a", "token": "t", "paths": []}, {"name": "a", "token": "u", "paths": []}]}`, true},
+		{"no secret", `{"credentials": [{"name": "a", "paths": ["/a"]}]}`, true},
+		{"token and secret", `{"credentials": [{"name": "a", "token": "t", "secret": "s", "paths": ["/a"]}]}`, true},
+		{"bad pattern", `{"credentials": [{"name": "a", "token": "t", "paths": ["a/*/b"]}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestPolicy(t, tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	policy, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &handshake{challenge: "c0ffee"}
+	sign := func(secret, challenge, clientId string) string {
+		return typedefs.SignChallenge([]byte(secret), challenge, clientId)
+	}
+	tests := []struct {
+		name     string
+		auth     *typedefs.Auth
+		hs       *handshake
+		clientId string
+		want     string // credential name, empty if rejected
+	}{
+		{"token", &typedefs.Auth{Token: "s3cret-token"}, hs, "w1", "ollama-box"},
+		{"token with key ID", &typedefs.Auth{KeyID: "ollama-box", Token: "s3cret-token"}, hs, "w1", "ollama-box"},
+		{"wrong token", &typedefs.Auth{Token: "guess"}, hs, "w1", ""},
+		{"token for another key ID", &typedefs.Auth{KeyID: "demo", Token: "s3cret-token"}, hs, "w1", ""},
+		{"signature", &typedefs.Auth{KeyID: "demo", Signature: sign("hmac-secret", "c0ffee", "w1")}, hs, "w1", "demo"},
+		{"signature without key ID", &typedefs.Auth{Signature: sign("hmac-secret", "c0ffee", "w1")}, hs, "w1", ""},
+		{"signature with wrong secret", &typedefs.Auth{KeyID: "demo", Signature: sign("guess", "c0ffee", "w1")}, hs, "w1", ""},
+		{"replayed signature", &typedefs.Auth{KeyID: "demo", Signature: sign("hmac-secret", "0ld", "w1")}, hs, "w1", ""},
+		{"signature for another client ID", &typedefs.Auth{KeyID: "demo", Signature: sign("hmac-secret", "c0ffee", "w2")}, hs, "w1", ""},
+		{"secret sent as token", &typedefs.Auth{KeyID: "demo", Token: "hmac-secret"}, hs, "w1", ""},
+		{"certificate subject", nil, &handshake{subject: "edge.example.com"}, "w1", "edge"},
+		{"unknown certificate subject", nil, &handshake{subject: "other.example.com"}, "w1", ""},
+		{"no credential", nil, hs, "w1", ""},
+		{"empty auth", &typedefs.Auth{}, hs, "w1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := policy.Authenticate(tt.auth, tt.hs, tt.clientId)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("authenticated as %q, want a rejection", cred.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Name != tt.want {
+				t.Errorf("authenticated as %q, want %q", cred.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRegistration(t *testing.T) {
+	policy, err := loadTestPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *AuthPolicy) { authPolicy = saved }(authPolicy)
+	authPolicy = policy
+
+	hs := &handshake{challenge: "c0ffee"}
+	tests := []struct {
+		name     string
+		auth     typedefs.Auth
+		paths    []interface{}
+		want     string // credential name when accepted
+		wantCode string // rejection code otherwise
+	}{
+		{"owned paths", typedefs.Auth{Token: "s3cret-token"}, []interface{}{"/ollama", "/ollama/api/{op}"}, "ollama-box", ""},
+		{"wrong token", typedefs.Auth{Token: "guess"}, []interface{}{"/ollama"}, "", typedefs.RejectUnauthenticated},
+		{"path not owned", typedefs.Auth{Token: "s3cret-token"}, []interface{}{"/ollama", "/weather"}, "", typedefs.RejectForbiddenPath},
+		{"broader than granted", typedefs.Auth{Token: "s3cret-token"}, []interface{}{"/*"}, "", typedefs.RejectForbiddenPath},
+		{"method not granted", typedefs.Auth{KeyID: "demo", Signature: typedefs.SignChallenge([]byte("hmac-secret"), "c0ffee", "w1")}, []interface{}{"POST /stocks/{symbol}"}, "", typedefs.RejectForbiddenPath},
+		{"method granted", typedefs.Auth{KeyID: "demo", Signature: typedefs.SignChallenge([]byte("hmac-secret"), "c0ffee", "w1")}, []interface{}{"GET /stocks/{symbol}", "/weather"}, "demo", ""},
+		{"invalid pattern", typedefs.Auth{Token: "s3cret-token"}, []interface{}{"/ollama/*/x"}, "", typedefs.RejectForbiddenPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, _ := json.Marshal(map[string]interface{}{"client_id": "w1", "Paths": tt.paths, "auth": tt.auth})
+			credential, rejection := authorizeRegistration(&typedefs.TcpMessage{Sub: "REG", Msg: payload}, hs, "w1", tt.paths)
+			if tt.wantCode != "" {
+				if rejection == nil || rejection.Code != tt.wantCode {
+					t.Fatalf("got %q, %v, want rejection %q", credential, rejection, tt.wantCode)
+				}
+				return
+			}
+			if rejection != nil {
+				t.Fatal(rejection)
+			}
+			if credential != tt.want {
+				t.Errorf("got credential %q, want %q", credential, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRegistrationWithoutPolicy(t *testing.T) {
+	defer func(saved *AuthPolicy) { authPolicy = saved }(authPolicy)
+	authPolicy = nil
+
+	msg := &typedefs.TcpMessage{Sub: "REG", Msg: []byte(`{"client_id":"w1","Paths":["/*"]}`)}
+	if credential, rejection := authorizeRegistration(msg, &handshake{}, "w1", []interface{}{"/*"}); credential != "" || rejection != nil {
+		t.Errorf("got %q, %v, want anonymous access", credential, rejection)
+	}
+	if credential, _ := authorizeRegistration(msg, &handshake{subject: "edge"}, "w1", []interface{}{"/*"}); credential != "cert:edge" {
+		t.Errorf("got credential %q, want cert:edge", credential)
+	}
+}
+
+func TestFramesBeforeRegistration(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	conn := &a
+
+	tests := []struct {
+		sub     string
+		wantErr bool
+	}{
+		{"HEARTBEAT_RESPONSE", false},
+		{"RESPONSE", true},
+		{"RESPONSE_CHUNK", true},
+		{"END", true},
+		{"WINDOW", true},
+		{"DRAIN", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			var frame bytes.Buffer
+			msg := &typedefs.TcpMessage{Sub: tt.sub, RequestId: "01HZX4T3QK8V6N0J2M5R7W9Y1B", Msg: []byte(`{"status_code":200}`)}
+			if err := typedefs.NewTcpMessageWriter(&frame).WriteMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+			err := handleTCPMessage(conn, typedefs.NewTcpMessageReader(&frame), &handshake{})
+			if got := errors.Is(err, errNotRegistered); got != tt.wantErr {
+				t.Errorf("got %v, want rejection %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponseFromAnotherConnection(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	owner, other := &a, &b
+
+	requests := NewPendingRequests()
+	responses, ok := requests.Add("req-1", owner, nil)
+	if !ok {
+		t.Fatal("Add failed")
+	}
+	defer requests.Remove("req-1")
+
+	forged := &ResponseManager{Requestid: "req-1", StatusCode: http.StatusOK}
+	if requests.Deliver("req-1", other, forged) || requests.Resolve("req-1", other, forged) {
+		t.Fatal("delivered a response from a connection the request was not sent on")
+	}
+	if requests.Len() != 1 || len(responses) != 0 {
+		t.Fatalf("forged response changed the request: %d pending, %d queued", requests.Len(), len(responses))
+	}
+
+	answer := &ResponseManager{Requestid: "req-1", StatusCode: http.StatusCreated}
+	if !requests.Resolve("req-1", owner, answer) {
+		t.Fatal("response from the worker the request was sent to was dropped")
+	}
+	if got := <-responses; got != answer {
+		t.Errorf("got %+v, want %+v", got, answer)
+	}
+}
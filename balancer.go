@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"multichannel/cmd/typedefs"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Strategy selects which worker in a pool serves a request.
+type Strategy string
+
+const (
+	RoundRobin    Strategy = "round_robin"
+	LeastInFlight Strategy = "least_in_flight"
+	Random        Strategy = "random"
+	HeaderHash    Strategy = "header_hash" // consistent hash on a request header
+)
+
+var (
+	// ErrNoRoute means no worker is registered for a path.
+	ErrNoRoute = errors.New("no worker registered for path")
+	// ErrSaturated means every worker for a path runs as many requests as it
+	// advertised.
+	ErrSaturated = errors.New("all workers for path are at capacity")
+)
+
+// hashReplicas is the number of points each worker gets on the hash ring.
+const hashReplicas = 64
+
+// ParseStrategy validates a strategy name.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case RoundRobin, LeastInFlight, Random, HeaderHash:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown load balancing strategy %q", name)
+}
+
+// WorkerPool holds every worker registered for a route.
+type WorkerPool struct {
+	mu       sync.Mutex
+	route    *typedefs.Route
+	strategy Strategy
+	members  []*TCPClient
+	next     int
+	ring     []ringPoint // sorted by hash, rebuilt when members change
+}
+
+type ringPoint struct {
+	hash   uint32
+	client *TCPClient
+}
+
+func NewWorkerPool(route *typedefs.Route, strategy Strategy) *WorkerPool {
+	return &WorkerPool{route: route, strategy: strategy}
+}
+
+// Route returns the route the pool's workers serve.
+func (p *WorkerPool) Route() *typedefs.Route {
+	return p.route
+}
+
+// Add puts a worker in the pool, replacing an earlier entry with the same
+// client ID.
+func (p *WorkerPool) Add(client *TCPClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, member := range p.members {
+		if member.ClientId == client.ClientId {
+			p.members[i] = client
+			p.rebuildRing()
+			return
+		}
+	}
+	p.members = append(p.members, client)
+	p.rebuildRing()
+}
+
+// Remove takes a worker out of the pool and reports how many remain.
+func (p *WorkerPool) Remove(client *TCPClient) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, member := range p.members {
+		if member == client {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			p.rebuildRing()
+			break
+		}
+	}
+	return len(p.members)
+}
+
+// Len returns the number of workers in the pool.
+func (p *WorkerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.members)
+}
+
+// Pick chooses a worker using the pool's strategy and reserves a request
+// slot on it. Workers at their advertised concurrency are passed over in
+// favour of the next candidate the strategy would pick. hashKey is only used
+// by HeaderHash; when it is empty the pool falls back to round-robin.
+func (p *WorkerPool) Pick(hashKey string) (*TCPClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.members) == 0 {
+		return nil, ErrNoRoute
+	}
+	for _, candidate := range p.candidates(hashKey) {
+		if candidate.acquire() {
+			return candidate, nil
+		}
+	}
+	return nil, ErrSaturated
+}
+
+// candidates returns the members in the order the strategy prefers them.
+func (p *WorkerPool) candidates(hashKey string) []*TCPClient {
+	switch p.strategy {
+	case LeastInFlight:
+		// Start from the round-robin position so ties are spread evenly
+		order := p.rotate()
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].InFlight() < order[j].InFlight()
+		})
+		return order
+	case Random:
+		order := make([]*TCPClient, len(p.members))
+		for i, j := range rand.Perm(len(p.members)) {
+			order[i] = p.members[j]
+		}
+		return order
+	case HeaderHash:
+		if hashKey != "" {
+			// Walk the ring from the key's point, so a busy worker's keys
+			// spill over to its successor
+			h := hashString(hashKey)
+			start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+			order := make([]*TCPClient, 0, len(p.members))
+			seen := make(map[*TCPClient]bool, len(p.members))
+			for i := 0; i < len(p.ring) && len(order) < len(p.members); i++ {
+				client := p.ring[(start+i)%len(p.ring)].client
+				if !seen[client] {
+					seen[client] = true
+					order = append(order, client)
+				}
+			}
+			return order
+		}
+	}
+	return p.rotate()
+}
+
+// rotate advances the round-robin position and returns the members starting
+// from it.
+func (p *WorkerPool) rotate() []*TCPClient {
+	p.next = (p.next + 1) % len(p.members)
+	order := make([]*TCPClient, 0, len(p.members))
+	order = append(order, p.members[p.next:]...)
+	return append(order, p.members[:p.next]...)
+}
+
+func (p *WorkerPool) rebuildRing() {
+	if p.strategy != HeaderHash {
+		return
+	}
+	p.ring = p.ring[:0]
+	for _, member := range p.members {
+		for i := 0; i < hashReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{
+				hash:   hashString(member.ClientId + "#" + strconv.Itoa(i)),
+				client: member,
+			})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
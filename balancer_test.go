@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"multichannel/cmd/typedefs"
+	"testing"
+)
+
+func newTestPool(t *testing.T, strategy Strategy, maxConcurrency ...int) (*WorkerPool, []*TCPClient) {
+	t.Helper()
+	route, err := typedefs.ParseRoute("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewWorkerPool(route, strategy)
+	clients := make([]*TCPClient, len(maxConcurrency))
+	for i, max := range maxConcurrency {
+		clients[i] = &TCPClient{ClientId: fmt.Sprintf("worker-%d", i), MaxConcurrency: max}
+		pool.Add(clients[i])
+	}
+	return pool, clients
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, name := range []string{"round_robin", "least_in_flight", "random", "header_hash"} {
+		if s, err := ParseStrategy(name); err != nil || string(s) != name {
+			t.Errorf("ParseStrategy(%q) = %q, %v", name, s, err)
+		}
+	}
+	if _, err := ParseStrategy("fastest"); err == nil {
+		t.Error("ParseStrategy accepted an unknown strategy")
+	}
+}
+
+func TestPickEmptyPool(t *testing.T) {
+	for _, strategy := range []Strategy{RoundRobin, LeastInFlight, Random, HeaderHash} {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool, _ := newTestPool(t, strategy)
+			if _, err := pool.Pick("key"); !errors.Is(err, ErrNoRoute) {
+				t.Errorf("got %v, want ErrNoRoute", err)
+			}
+		})
+	}
+}
+
+func TestPickSaturated(t *testing.T) {
+	for _, strategy := range []Strategy{RoundRobin, LeastInFlight, Random, HeaderHash} {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool, clients := newTestPool(t, strategy, 1, 2)
+			for i := 0; i < 3; i++ {
+				if _, err := pool.Pick("key"); err != nil {
+					t.Fatalf("pick %d: %v", i, err)
+				}
+			}
+			if _, err := pool.Pick("key"); !errors.Is(err, ErrSaturated) {
+				t.Fatalf("got %v, want ErrSaturated", err)
+			}
+			clients[1].release()
+			client, err := pool.Pick("key")
+			if err != nil || client != clients[1] {
+				t.Errorf("got %v, %v after a slot was released, want worker-1", client, err)
+			}
+		})
+	}
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	pool, clients := newTestPool(t, RoundRobin, 0, 0, 0)
+	counts := make(map[*TCPClient]int)
+	for i := 0; i < 9; i++ {
+		client, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[client]++
+	}
+	for _, client := range clients {
+		if counts[client] != 3 {
+			t.Errorf("%s got %d requests, want 3", client.ClientId, counts[client])
+		}
+	}
+}
+
+func TestPickLeastInFlight(t *testing.T) {
+	pool, clients := newTestPool(t, LeastInFlight, 0, 0, 0)
+	clients[0].acquire()
+	clients[0].acquire()
+	clients[2].acquire()
+	client, err := pool.Pick("")
+	if err != nil || client != clients[1] {
+		t.Fatalf("got %v, %v, want the idle worker-1", client, err)
+	}
+	// Every worker now runs one request but worker-0, which runs two
+	for i := 0; i < 2; i++ {
+		if client, _ := pool.Pick(""); client == clients[0] {
+			t.Errorf("pick %d went to the busiest worker", i)
+		}
+	}
+}
+
+func TestPickRandom(t *testing.T) {
+	pool, clients := newTestPool(t, Random, 0, 0)
+	counts := make(map[*TCPClient]int)
+	for i := 0; i < 200; i++ {
+		client, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[client]++
+	}
+	for _, client := range clients {
+		if counts[client] == 0 {
+			t.Errorf("%s was never picked", client.ClientId)
+		}
+	}
+}
+
+func TestPickHeaderHash(t *testing.T) {
+	pool, clients := newTestPool(t, HeaderHash, 0, 0, 0)
+	owners := make(map[string]*TCPClient)
+	used := make(map[*TCPClient]bool)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		client, err := pool.Pick(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owners[key] = client
+		used[client] = true
+	}
+	if len(used) != len(clients) {
+		t.Errorf("keys spread over %d workers, want %d", len(used), len(clients))
+	}
+	for key, owner := range owners {
+		if client, _ := pool.Pick(key); client != owner {
+			t.Errorf("%s moved from %s to %s", key, owner.ClientId, client.ClientId)
+		}
+	}
+
+	// Removing a worker only moves its own keys
+	pool.Remove(clients[0])
+	for key, owner := range owners {
+		client, err := pool.Pick(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != clients[0] && client != owner {
+			t.Errorf("%s moved from %s to %s", key, owner.ClientId, client.ClientId)
+		}
+	}
+}
+
+func TestPickHeaderHashSpillover(t *testing.T) {
+	pool, _ := newTestPool(t, HeaderHash, 1, 1)
+	owner, err := pool.Pick("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := pool.Pick("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == owner {
+		t.Fatalf("picked the busy worker %s again", owner.ClientId)
+	}
+	owner.release()
+	if client, _ := pool.Pick("user-1"); client != owner {
+		t.Errorf("got %v, want the key to return to %s", client, owner.ClientId)
+	}
+}
+
+func TestWorkerPoolAddRemove(t *testing.T) {
+	pool, clients := newTestPool(t, RoundRobin, 0, 0)
+	replacement := &TCPClient{ClientId: clients[0].ClientId}
+	pool.Add(replacement)
+	if pool.Len() != 2 {
+		t.Fatalf("got %d workers after re-registering worker-0, want 2", pool.Len())
+	}
+	if n := pool.Remove(clients[0]); n != 2 {
+		t.Errorf("removing a replaced worker left %d, want 2", n)
+	}
+	if n := pool.Remove(replacement); n != 1 {
+		t.Errorf("got %d workers left, want 1", n)
+	}
+	for i := 0; i < 3; i++ {
+		if client, _ := pool.Pick(""); client != clients[1] {
+			t.Errorf("got %v, want the remaining worker-1", client)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// HTTPHandler adapts a standard http.Handler, such as a gorilla/mux router,
+// into a Callback. The handler sees the request as the HTTP caller sent it,
+// with the original path, so a router can be mounted under a prefix route
+// like "/api/*" unchanged.
+//
+// The response is buffered and sent in one RESPONSE frame when the handler
+// returns. A handler that calls Flush switches to a streamed response: the
+// status and headers are sent at the first Flush and the body follows as it
+// is written, which keeps server-sent events and long downloads working.
+func HTTPHandler(h http.Handler) Callback {
+	return func(ctx context.Context, request typedefs.Request) interface{} {
+		req, err := NewHTTPRequest(ctx, request)
+		if err != nil {
+			return err
+		}
+		rec := newResponseRecorder()
+		go rec.serve(h, req, request.RequestId)
+
+		select {
+		case <-rec.ready:
+			return rec.response
+		case <-ctx.Done():
+			// Nobody reads a late streamed body; close it so the handler's
+			// writes fail instead of blocking forever
+			go func() {
+				<-rec.ready
+				if rec.response.BodyReader != nil {
+					rec.response.BodyReader.(io.Closer).Close()
+				}
+			}()
+			return ctx.Err()
+		}
+	}
+}
+
+// NewHTTPRequest converts a tunnelled request into an *http.Request bound to
+// ctx, as a net/http server would have received it.
+func NewHTTPRequest(ctx context.Context, request typedefs.Request) (*http.Request, error) {
+	body := request.BodyReader
+	contentLength := int64(-1)
+	if body == nil {
+		body = bytes.NewReader(request.Body)
+	}
+	if !request.Stream {
+		contentLength = int64(len(request.Body))
+	}
+
+	// As on a server, URL holds only the path and query; the host is in Host
+	requestURI := request.URL().RequestURI()
+	req, err := http.NewRequestWithContext(ctx, request.Method, requestURI, body)
+	if err != nil {
+		return nil, fmt.Errorf("converting request %s: %w", request.RequestId, err)
+	}
+	req.RequestURI = requestURI
+	req.ContentLength = contentLength
+	req.Header = make(http.Header, len(request.Headers))
+	for key, values := range request.Headers {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if request.Host != "" {
+		req.Host = request.Host
+	}
+	if request.Proto != "" {
+		if major, minor, ok := http.ParseHTTPVersion(request.Proto); ok {
+			req.Proto, req.ProtoMajor, req.ProtoMinor = request.Proto, major, minor
+		}
+	}
+	if request.RemoteAddr != "" {
+		// Handlers expect "IP:port"; the client port is not forwarded
+		req.RemoteAddr = net.JoinHostPort(request.RemoteAddr, "0")
+	}
+	if request.TLS != nil {
+		// Only the server name is known; a non-nil TLS field is what
+		// handlers check to tell HTTPS requests apart
+		req.TLS = &tls.ConnectionState{HandshakeComplete: true, ServerName: request.TLS.ServerName}
+	}
+	return req, nil
+}
+
+// responseRecorder is the http.ResponseWriter handed to adapted handlers. It
+// is only used from the handler's goroutine; ready is closed once response
+// holds the buffered response or the head of a streamed one.
+type responseRecorder struct {
+	header      http.Header
+	sent        http.Header // header as of WriteHeader
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	stream      *io.PipeWriter // set once the handler flushed
+
+	response *typedefs.Response
+	ready    chan struct{}
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header: make(http.Header),
+		status: http.StatusOK,
+		ready:  make(chan struct{}),
+	}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+	// Like net/http, later header changes are not sent
+	r.sent = r.header.Clone()
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.stream != nil {
+		return r.stream.Write(p)
+	}
+	return r.body.Write(p)
+}
+
+// Flush sends the status and headers, then switches to streaming the body.
+func (r *responseRecorder) Flush() {
+	if r.stream != nil {
+		return
+	}
+	r.WriteHeader(http.StatusOK)
+	pr, pw := io.Pipe()
+	r.stream = pw
+	r.response = r.head()
+	r.response.BodyReader = &streamBody{
+		Reader: io.MultiReader(bytes.NewReader(r.body.Bytes()), pr),
+		pipe:   pr,
+	}
+	close(r.ready)
+}
+
+// serve runs h and completes the response when it returns. A panicking
+// handler is answered with a 500, or ends a streamed body with an error.
+func (r *responseRecorder) serve(h http.Handler, req *http.Request, requestId string) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("HTTP handler panicked", logging.RequestID, requestId, logging.Path, req.URL.Path,
+				"panic", p, "stack", string(debug.Stack()))
+			err := fmt.Errorf("handler panic: %v", p)
+			if r.stream != nil {
+				r.stream.CloseWithError(err)
+				return
+			}
+			r.response = typedefs.NewErrorResponse(http.StatusInternalServerError, err)
+			close(r.ready)
+		}
+	}()
+
+	h.ServeHTTP(r, req)
+
+	if r.stream != nil {
+		r.stream.Close()
+		return
+	}
+	r.response = r.head()
+	r.response.Body = r.body.Bytes()
+	close(r.ready)
+}
+
+func (r *responseRecorder) head() *typedefs.Response {
+	header := r.sent
+	if !r.wroteHeader {
+		header = r.header.Clone()
+	}
+	return &typedefs.Response{
+		StatusCode: int32(r.status),
+		Headers:    typedefs.Headers(header),
+	}
+}
+
+// streamBody is the BodyReader of a streamed response. Closing it makes the
+// handler's further writes fail.
+type streamBody struct {
+	io.Reader
+	pipe *io.PipeReader
+}
+
+func (s *streamBody) Close() error {
+	return s.pipe.Close()
+}
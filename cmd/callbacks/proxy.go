@@ -0,0 +1,123 @@
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"multichannel/cmd/typedefs"
+	"multichannel/http/lib"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig configures a Proxy callback.
+type ProxyConfig struct {
+	// Upstream is the base URL requests are forwarded to; its path is
+	// prepended to the request path.
+	Upstream *url.URL
+	// StripPrefix is removed from the request path before forwarding, so
+	// "/app/*" can be served by an upstream rooted at "/".
+	StripPrefix string
+	// Host is the Host header sent upstream. When empty the upstream's own
+	// host is used, unless PreserveHost keeps the one the caller sent.
+	Host         string
+	PreserveHost bool
+	Client       *lib.HttpClient
+}
+
+// Proxy returns a callback that forwards requests to cfg.Upstream and relays
+// the status, headers and body back. Small responses are sent in one frame;
+// larger or unsized ones are streamed. An unreachable upstream is answered
+// with 502.
+func Proxy(cfg ProxyConfig) Callback {
+	if cfg.Client == nil {
+		cfg.Client = lib.NewProxyHttpClient(0)
+	}
+	return func(ctx context.Context, request typedefs.Request) interface{} {
+		req, err := cfg.upstreamRequest(ctx, request)
+		if err != nil {
+			return typedefs.NewErrorResponse(http.StatusBadRequest, err)
+		}
+		res, err := cfg.Client.Do(req)
+		if err != nil {
+			return typedefs.NewErrorResponse(http.StatusBadGateway, fmt.Errorf("upstream: %w", err))
+		}
+
+		response := &typedefs.Response{
+			StatusCode: int32(res.StatusCode),
+			Headers:    typedefs.Headers(res.Header),
+		}
+		if res.ContentLength < 0 || res.ContentLength > typedefs.ChunkSize {
+			response.BodyReader = res.Body
+			return response
+		}
+		defer res.Body.Close()
+		if response.Body, err = io.ReadAll(res.Body); err != nil {
+			return typedefs.NewErrorResponse(http.StatusBadGateway, fmt.Errorf("upstream: %w", err))
+		}
+		return response
+	}
+}
+
+// upstreamRequest builds the request sent to the upstream for request.
+func (cfg *ProxyConfig) upstreamRequest(ctx context.Context, request typedefs.Request) (*http.Request, error) {
+	path, stripped := stripPrefix(request.Path, cfg.StripPrefix)
+	target := *cfg.Upstream
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+	target.RawPath = ""
+	switch {
+	case target.RawQuery == "":
+		target.RawQuery = request.RawQuery
+	case request.RawQuery != "":
+		target.RawQuery += "&" + request.RawQuery
+	}
+
+	body := request.BodyReader
+	if body == nil {
+		body = bytes.NewReader(request.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, request.Method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if request.Stream {
+		req.ContentLength = -1
+	} else {
+		req.ContentLength = int64(len(request.Body))
+	}
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	// The gateway already removed hop-by-hop headers and set X-Forwarded-*
+	for key, values := range request.Headers {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if stripped {
+		req.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(cfg.StripPrefix, "/"))
+	}
+	switch {
+	case cfg.Host != "":
+		req.Host = cfg.Host
+	case cfg.PreserveHost && request.Host != "":
+		req.Host = request.Host
+	}
+	return req, nil
+}
+
+// stripPrefix removes prefix from path when it covers whole segments, so
+// "/app" strips "/app" and "/app/x" but leaves "/application" alone. The
+// result always starts with a slash. It reports whether prefix was removed.
+func stripPrefix(path, prefix string) (string, bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || (path != prefix && !strings.HasPrefix(path, prefix+"/")) {
+		return path, false
+	}
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, true
+}
@@ -0,0 +1,48 @@
+package callbacks
+
+import (
+	"context"
+	"multichannel/cmd/typedefs"
+	"net/url"
+	"testing"
+)
+
+func TestUpstreamRequestStripPrefix(t *testing.T) {
+	tests := []struct {
+		upstream    string
+		stripPrefix string
+		path        string
+		want        string
+		wantPrefix  string
+	}{
+		{"http://localhost:3000", "/app", "/app", "/", "/app"},
+		{"http://localhost:3000", "/app", "/app/", "/", "/app"},
+		{"http://localhost:3000", "/app", "/app/x", "/x", "/app"},
+		{"http://localhost:3000", "/app/", "/app/x", "/x", "/app"},
+		{"http://localhost:3000", "/app", "/application", "/application", ""},
+		{"http://localhost:3000", "/app", "/application/x", "/application/x", ""},
+		{"http://localhost:3000", "/app", "/other", "/other", ""},
+		{"http://localhost:3000", "", "/app/x", "/app/x", ""},
+		{"http://localhost:3000/base", "/app", "/app/x", "/base/x", "/app"},
+		{"http://localhost:3000/base/", "/app", "/application", "/base/application", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream+" "+tt.stripPrefix+" "+tt.path, func(t *testing.T) {
+			upstream, err := url.Parse(tt.upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &ProxyConfig{Upstream: upstream, StripPrefix: tt.stripPrefix}
+			req, err := cfg.upstreamRequest(context.Background(), typedefs.Request{Method: "GET", Path: tt.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.URL.Path != tt.want {
+				t.Errorf("got path %q, want %q", req.URL.Path, tt.want)
+			}
+			if got := req.Header.Get("X-Forwarded-Prefix"); got != tt.wantPrefix {
+				t.Errorf("got X-Forwarded-Prefix %q, want %q", got, tt.wantPrefix)
+			}
+		})
+	}
+}
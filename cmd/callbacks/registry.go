@@ -1,24 +1,40 @@
 package callbacks
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"multichannel/cmd/typedefs"
+	"net/http"
 )
 
+// ErrCallbackNotFound is returned by Execute when no callback is registered
+// for the requested path.
+var ErrCallbackNotFound = errors.New("callback not found")
+
+// Callback serves a request routed to the worker. ctx is cancelled when the
+// HTTP caller goes away or the gateway gives up on the request, so long
+// running callbacks should pass it on and return early.
+type Callback func(ctx context.Context, request typedefs.Request) interface{}
+
 // CallbackRegistry stores mapping of callback functions
 type CallbackRegistry struct {
-	callbacks map[string]func(typedefs.Request) interface{}
+	callbacks map[string]Callback // route pattern -> callback
+	routes    []*typedefs.Route
 }
 
 // NewCallbackRegistry creates a new registry
 func NewCallbackRegistry() *CallbackRegistry {
 	return &CallbackRegistry{
-		callbacks: make(map[string]func(typedefs.Request) interface{}),
+		callbacks: make(map[string]Callback),
 	}
 }
 
-// Execute calls the registered function by name with provided arguments
+// Execute calls the registered function by name with provided arguments and
+// returns the JSON-encoded typedefs.Response to send back in a RESPONSE frame.
+// Streamed callback bodies are read in full.
 func (r *CallbackRegistry) Execute(name string, args ...interface{}) ([]byte, error) {
 	if name != "REQUEST" || len(args) != 1 {
 		return nil, fmt.Errorf("callback %s not found", name)
@@ -34,19 +50,74 @@ func (r *CallbackRegistry) Execute(name string, args ...interface{}) ([]byte, er
 		return nil, err
 	}
 	//return []byte(fmt.Sprintf("Received request: %v %v", request.Path, request.Method)), nil
-	callback, exists := r.callbacks[request.Path]
+	response, err := r.Handle(context.Background(), request)
+	if err != nil {
+		return nil, err
+	}
+	if response.BodyReader != nil {
+		response.Body, err = io.ReadAll(response.BodyReader)
+		if closer, ok := response.BodyReader.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(response)
+}
+
+// Handle runs the callback registered for the route the gateway matched,
+// or for the most specific route matching request.Path when the gateway sent
+// none, with ctx and the request's path parameters. Callbacks may return
+// a typedefs.Response to control the status code (200 if unset), headers
+// and body, or set its BodyReader to stream the body; any other value is
+// sent as a 200 JSON body, and an error result is returned as an error.
+func (r *CallbackRegistry) Handle(ctx context.Context, request typedefs.Request) (*typedefs.Response, error) {
+	callback, exists := r.callbacks[request.Route]
 	if !exists {
-		return nil, fmt.Errorf("callback %s not found", name)
+		route, params, err := typedefs.MatchRoute(r.routes, request.Method, request.Path)
+		if errors.Is(err, typedefs.ErrMethodNotAllowed) {
+			return nil, fmt.Errorf("%w: %s %s", err, request.Method, request.Path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCallbackNotFound, request.Path)
+		}
+		callback = r.callbacks[route.Pattern]
+		request.Route, request.Params = route.Pattern, params
+	} else if request.Params == nil {
+		// Codecs that do not carry parameters leave them to the worker
+		for _, route := range r.routes {
+			if route.Pattern == request.Route {
+				request.Params, _ = route.Match(request.Path)
+			}
+		}
 	}
 
-	result := callback(request)
+	result := callback(ctx, request)
 
-	resultBytes, err := json.Marshal(result)
-	if err != nil {
-		return nil, err
+	switch v := result.(type) {
+	case *typedefs.Response:
+		if v == nil {
+			return nil, errors.New("callback returned no result")
+		}
+		return withStatus(*v), nil
+	case typedefs.Response:
+		return withStatus(v), nil
+	case error:
+		return nil, v
+	default:
+		return typedefs.NewJSONResponse(http.StatusOK, v)
 	}
+}
 
-	return resultBytes, nil
+// withStatus returns response with the status 200 when the callback left
+// it unset, as net/http does.
+func withStatus(response typedefs.Response) *typedefs.Response {
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
+	return &response
 }
 
 // GetRegisteredCallbacks returns all registered callback names
@@ -58,8 +129,16 @@ func (r *CallbackRegistry) GetRegisteredCallbacks() []string {
 	return names
 }
 
-// Register adds a callback function to the registry
-func (r *CallbackRegistry) Register(name string, callback func(typedefs.Request) interface{}) error {
+// Register adds a callback function to the registry for a route pattern,
+// see typedefs.Route.
+func (r *CallbackRegistry) Register(name string, callback Callback) error {
+	route, err := typedefs.ParseRoute(name)
+	if err != nil {
+		return err
+	}
+	if _, exists := r.callbacks[name]; !exists {
+		r.routes = append(r.routes, route)
+	}
 	r.callbacks[name] = callback
 	return nil
 }
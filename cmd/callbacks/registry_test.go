@@ -0,0 +1,71 @@
+package callbacks
+
+import (
+	"bytes"
+	"context"
+	"multichannel/cmd/typedefs"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandleDefaultsStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		result interface{}
+		want   int32
+	}{
+		{"response value", typedefs.Response{Body: []byte("hello")}, http.StatusOK},
+		{"response pointer", &typedefs.Response{Body: []byte("hello")}, http.StatusOK},
+		{"streamed response", typedefs.Response{BodyReader: strings.NewReader("hello"), Stream: true}, http.StatusOK},
+		{"explicit status", typedefs.Response{StatusCode: http.StatusAccepted}, http.StatusAccepted},
+		{"other value", map[string]string{"a": "b"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewCallbackRegistry()
+			registry.Register("/test", func(ctx context.Context, request typedefs.Request) interface{} {
+				return tt.result
+			})
+			response, err := registry.Handle(context.Background(), typedefs.Request{Method: "GET", Path: "/test", Route: "/test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.want {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+// A streamed response without a status must reach the gateway as a
+// streamed 200, not as its encoded envelope.
+func TestHandleStreamedResponseWithoutStatus(t *testing.T) {
+	registry := NewCallbackRegistry()
+	registry.Register("/stream", func(ctx context.Context, request typedefs.Request) interface{} {
+		return typedefs.Response{BodyReader: strings.NewReader("hello"), Stream: true}
+	})
+	response, err := registry.Handle(context.Background(), typedefs.Request{Method: "GET", Path: "/stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, codec := range []typedefs.Codec{typedefs.JSONCodec, typedefs.ProtobufCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			var wire bytes.Buffer
+			frames := typedefs.NewTcpMessageWriter(&wire)
+			frames.SetCodec(codec)
+			if err := frames.WriteResponse("RESPONSE", "01HZX4T3QK8V6N0J2M5R7W9Y1B", response); err != nil {
+				t.Fatal(err)
+			}
+			message, err := typedefs.NewTcpMessageReader(&wire).ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := message.DecodeResponse(http.StatusOK)
+			if got.StatusCode != http.StatusOK || !got.Stream || len(got.Body) != 0 {
+				t.Errorf("got status %d, stream %v, body %q", got.StatusCode, got.Stream, got.Body)
+			}
+		})
+	}
+}
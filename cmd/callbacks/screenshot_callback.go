@@ -1,42 +1,68 @@
 package callbacks
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"multichannel/cmd/logging"
 	"multichannel/cmd/typedefs"
 	"multichannel/screenshot"
+	"net/http"
+	"sync"
 )
 
-var screenshotManager *screenshot.ScreenshotManager
+var (
+	screenshotManager *screenshot.ScreenshotManager
+	screenshotOnce    sync.Once
+)
 
-func init() {
-	screenshotManager = screenshot.NewScreenshotManager()
+// getScreenshotManager starts the browser on first use, so importing this
+// package does not launch Chrome in every worker.
+func getScreenshotManager() *screenshot.ScreenshotManager {
+	screenshotOnce.Do(func() {
+		screenshotManager = screenshot.NewScreenshotManager()
+		if screenshotManager != nil {
+			// Progress updates are not forwarded through the tunnel; drain them so
+			// captures do not block once the channel buffer fills up.
+			go func() {
+				for range screenshotManager.ProgressChan {
+				}
+			}()
+		}
+	})
+	return screenshotManager
 }
 
-// ScreenshotCallback handles screenshot requests
-func ScreenshotCallback(req typedefs.Request) interface{} {
+// ScreenshotCallback handles screenshot requests. The capture is aborted
+// when ctx is cancelled.
+func ScreenshotCallback(ctx context.Context, req typedefs.Request) interface{} {
+	screenshotManager := getScreenshotManager()
+	if screenshotManager == nil {
+		return typedefs.NewErrorResponse(http.StatusServiceUnavailable, errors.New("browser is not available"))
+	}
+
 	// Parse request body if any parameters are needed
-	var params map[string]interface{}
+	opts := screenshot.CaptureOptions{URL: "about:blank", HeadlessMode: true}
 	if len(req.Body) > 0 {
-		if err := json.Unmarshal(req.Body, &params); err != nil {
-			log.Printf("Error parsing screenshot parameters: %v", err)
+		if err := json.Unmarshal(req.Body, &opts); err != nil {
+			slog.Warn("Invalid screenshot parameters", logging.RequestID, req.RequestId, "error", err)
+			return typedefs.NewErrorResponse(http.StatusBadRequest, err)
 		}
 	}
 
 	// Capture screenshot
-	base64Image, err := screenshotManager.CaptureScreen()
+	metrics, err := screenshotManager.CaptureMetricsContext(ctx, opts)
 	if err != nil {
-		return map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		}
+		return typedefs.NewErrorResponse(http.StatusBadGateway, err)
 	}
 
 	// Return response
 	return map[string]interface{}{
-		"success":     true,
-		"image":       base64Image,
-		"timestamp":   screenshotManager.GetLastCaptureTime(),
+		"success":    true,
+		"image":      metrics.Screenshot,
+		"title":      metrics.Title,
+		"timestamp":  metrics.LastCapture,
 		"image_type": "png",
 		"encoding":   "base64",
 	}
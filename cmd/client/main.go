@@ -1,389 +1,112 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"github.com/google/uuid"
-	"io"
-	"log"
-	ollama "multichannel/aiapp"
-	"multichannel/cmd/callbacks"
-	"multichannel/cmd/messages"
-	conversion "multichannel/cmd/protos"
-	"multichannel/cmd/typedefs"
-	grpcclient "multichannel/grpc/client"
-	"multichannel/http/lib"
-	"net"
+	"context"
+	"log/slog"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/tlsconfig"
+	"multichannel/cmd/tracing"
+	"multichannel/examples/demo"
+	"multichannel/worker"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-type OllamaI struct {
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Stream bool   `json:"stream"`
-	Format string `json:"format"`
-}
-
-type ClientBlock struct {
-	Host             string
-	HTTP             int
-	TCP              int
-	GRPC             int
-	Paths            []string
-	ClientId         string
-	callbackRegistry *callbacks.CallbackRegistry
-}
-
-var (
-	bytechan     = make(chan []byte, 100)
-	client       = lib.NewHttpClient()
-	ollamaclient = ollama.NewClient("http://192.168.1.10:11435")
-)
-
-func init() {
-	log.SetFlags(log.LstdFlags | log.Llongfile)
-
-}
-
-func (b *ClientBlock) Process() {
-	msg := typedefs.TcpMessage{}
-	msg.Msg = json.RawMessage{}
-
-	// Process the message based on its type
-	if msg.Sub != "" {
-		results, err := b.callbackRegistry.Execute(msg.Sub, msg.Msg)
+func main() {
+	// Text or JSON records, at a level that can be changed on the metrics
+	// server below
+	logLevel, err := logging.Setup(getenv("MULTICHANNEL_LOG_FORMAT", "text"), getenv("MULTICHANNEL_LOG_LEVEL", "info"))
+	if err != nil {
+		logging.Fatal("Invalid log configuration", "error", err)
+	}
+
+	opts := []worker.Option{
+		worker.WithHost("localhost"),
+		worker.WithHTTPPort(8080),
+		worker.WithTCPPort(8081),
+		worker.WithGRPCPort(50051),
+		worker.WithStateChange(func(from, to worker.ConnState) {
+			slog.Info("Worker readiness changed", "ready", to == worker.StateRegistered)
+		}),
+	}
+	// Credentials for gateways started with -auth-policy
+	if secret := os.Getenv("MULTICHANNEL_SECRET"); secret != "" {
+		opts = append(opts, worker.WithHMAC(os.Getenv("MULTICHANNEL_KEY_ID"), []byte(secret)))
+	} else if token := os.Getenv("MULTICHANNEL_TOKEN"); token != "" {
+		opts = append(opts, worker.WithToken(token))
+	}
+	// TLS for gateways started with -tls-cert; a client certificate
+	// identifies the worker to gateways verifying them
+	tlsFiles := tlsconfig.Files{
+		CAFile:   os.Getenv("MULTICHANNEL_TLS_CA"),
+		CertFile: os.Getenv("MULTICHANNEL_TLS_CERT"),
+		KeyFile:  os.Getenv("MULTICHANNEL_TLS_KEY"),
+	}
+	if tlsFiles != (tlsconfig.Files{}) {
+		reloader, err := tlsconfig.NewReloader(tlsFiles)
 		if err != nil {
-			log.Printf("Error executing callback for %s: %v", msg.Sub, err)
-			return
+			logging.Fatal("Invalid TLS configuration", "error", err)
 		}
-		log.Printf("Callback results: %v", results)
+		go reloader.Watch(30*time.Second, nil)
+		opts = append(opts, worker.WithTLS(reloader.ClientConfig("")))
 	}
-}
-
-func (b *ClientBlock) RegisterGRPC() error {
-	grpcClient, err := grpcclient.NewRegisterClient(fmt.Sprintf("%s:%d", b.Host, b.GRPC))
-	if err != nil {
-		return fmt.Errorf("failed to create gRPC client: %v", err)
-	}
-
-	resp, err := grpcClient.Register(b.ClientId, "test@example.com", "password123")
-	if err != nil {
-		return fmt.Errorf("failed to register via gRPC: %v", err)
-	}
-
-	log.Printf("GRPC Registration response: success=%v, message=%s, userId=%s",
-		resp.Success, resp.Message, resp.UserId)
-	return nil
-}
-
-func (b *ClientBlock) Reg(conn *net.Conn, writer *typedefs.TcpMessageWriter) {
-	payload, err := json.Marshal(map[string]interface{}{
-		"client_id": b.ClientId,
-		"Paths":     b.Paths,
-	})
-	if err != nil {
-		log.Printf("Error marshalling JSON: %v", err)
-		return
-	}
-	msg := typedefs.TcpMessage{
-		Sub: "REG",
-		Msg: payload,
-	}
-
-	err = writer.WriteMessage(&msg)
-	if err != nil {
-		log.Printf("Error sending registration message: %v", err)
-		return
-	}
-	log.Printf("Registration message sent")
-}
-
-func TcpSender(bytechan chan []byte, conn *net.Conn) {
-	for {
-		select {
-		case msg := <-bytechan:
-			_, err := (*conn).Write(msg)
-			if err != nil {
-				fmt.Println("Error writing to TCP server:", err)
-			}
+	// Spans around callbacks, as OTLP JSON to a collector URL or a file
+	if target := os.Getenv("MULTICHANNEL_TRACE_EXPORT"); target != "" {
+		exporter, err := tracing.NewExporter(target)
+		if err != nil {
+			logging.Fatal("Invalid MULTICHANNEL_TRACE_EXPORT", "error", err)
 		}
+		defer exporter.Close()
+		opts = append(opts, worker.WithTracer(tracing.NewTracer("multichannel-worker", exporter, 1)))
 	}
-}
-
-func (b *ClientBlock) TcpSend(conn *net.Conn) {
-	msg := typedefs.TcpMessage{}
-	msg.Sub = "RESPONSE"
-	msg.Msg = conversion.HttpResponse{
-		StatusCode: 200,
-		Headers:    nil,
-		Body:       []byte("Hello World"),
-	}.ToBytes()
-	//msg.Msg = []byte(fmt.Sprintf("Client %s is alive at %s", b.ClientId, time.Now().String()))
-	jsonData, err := json.Marshal(msg)
-	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
-	}
-	//jsonMessage := append(jsonData, '\n')
-	_, err = (*conn).Write(jsonData)
-	if err != nil {
-		fmt.Println("Error writing to TCP server:", err)
-	}
-}
-
-func main() {
-	block := &ClientBlock{
-		Host: "localhost",
-		HTTP: 8080,
-		TCP:  8081, // Updated to match server's TCP port
-		GRPC: 50051,
-		Paths: []string{
-			"/stocks",
-			"/weather",
-			"/crypto",
-			"/ollama",
-			"/screenshot",  // Add screenshot path
-		},
-		callbackRegistry: callbacks.NewCallbackRegistry(),
-	}
-
-	log.Printf("Initialized client block with TCP port: %d", block.TCP)
+	w := worker.New(opts...)
 
 	// Register callback functions
-	block.callbackRegistry.Register("/stocks", stocksCallback)
-	block.callbackRegistry.Register("/weather", weatherCallback)
-	block.callbackRegistry.Register("/crypto", cryptoCallback)
-	block.callbackRegistry.Register("/ollama", ollamaCallback)
-	block.callbackRegistry.Register("/screenshot", callbacks.ScreenshotCallback)  // Register screenshot callback
-
-	// Register using HTTP
-	block.Register()
-
-	// Register using gRPC
-	if err := block.RegisterGRPC(); err != nil {
-		log.Printf("gRPC registration failed: %v", err)
-	}
-
-	// Connect via TCP
-	block.TcpConnect()
-	block.Process()
-}
-func (b *ClientBlock) Register() {
-	request := messages.RegisterRequest{
-		ClientId: uuid.New().String(),
-		Paths:    b.Paths,
-	}
-	b.ClientId = request.ClientId
-	url := fmt.Sprintf("http://%s:%d/register", b.Host, b.HTTP)
-	log.Println("Registering with server at", url)
-	jsonData, err := json.Marshal(request)
-	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
-		return
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Println("Error creating request:", err)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error making request:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	fmt.Println("Response status:", resp.Status)
-	response := messages.RegisterResponse{}
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		return
-	}
-}
-
-func (b *ClientBlock) TcpConnect() {
-	log.Printf("Attempting to connect to TCP server with port: %d", b.TCP)
-	address := fmt.Sprintf("127.0.0.1:%d", b.TCP)
-	log.Printf("Using address: %s", address)
-	var conn net.Conn
-	var err error
-
-	// Function to establish a connection
-	connect := func() {
-		for {
-			log.Printf("Dialing TCP4 at address: %s", address)
-			conn, err = net.Dial("tcp4", address)
-			if err == nil {
-				log.Printf("Successfully connected to TCP server at %s", address)
-				break
-			}
-			log.Printf("Error connecting to TCP server: %v", err)
-			time.Sleep(5 * time.Second) // Wait before retrying
+	demo.Register(w)
+
+	// Serve the worker's Prometheus metrics, and its log level to callers
+	// presenting the admin token
+	if addr := os.Getenv("MULTICHANNEL_METRICS_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", w.Metrics())
+		if token := os.Getenv("MULTICHANNEL_ADMIN_TOKEN"); token != "" {
+			mux.Handle("/log-level", logging.RequireToken(token, logging.LevelHandler(logLevel)))
 		}
-	}
-
-	// Establish initial connection
-	connect()
-	defer conn.Close()
-	// create a reder and writer
-	reader := typedefs.NewTcpMessageReader(conn)
-	writer := typedefs.NewTcpMessageWriter(conn)
-
-	// Read welcome message
-	welcome, err := reader.ReadMessage()
-	if err != nil {
-		log.Printf("Error reading welcome message: %v", err)
-		return
-	}
-	log.Printf("Received welcome message: %s - %v", welcome.Sub, string(welcome.Msg))
-
-	// Send registration message
-	b.Reg(&conn, writer)
-
-	// Handle server responses
-	for {
-		response, err := reader.ReadMessage()
-		if response == nil {
-			//log.Printf("Received nil message from server")
-			continue
-		}
-		log.Printf("Client received message type: %s", response)
-		if err != nil {
-			if err == io.EOF {
-				log.Printf("Connection closed by server")
-				//conn.Close()
-				//connect() // Reconnect
-				continue
-			}
-			log.Printf("Error reading from server: %v", err)
-
-		}
-
-		//log.Printf("Client received message type: %s", response.Sub)
-		switch response.Sub {
-		case "REQUEST":
-			log.Printf("HTTP response: %v", string(response.Msg))
-			var request map[string]interface{}
-			err := json.Unmarshal(response.Msg, &request)
-			if err != nil {
-				log.Printf("Error unmarshalling request: %v", err)
-				continue
+		go func() {
+			slog.Info("Serving metrics", "addr", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				slog.Error("Admin server failed", "addr", addr, "error", err)
 			}
-
-			requestid := int32(request["request_id"].(float64))
-
-			result, err := b.callbackRegistry.Execute(response.Sub, response.Msg)
-
-			if err != nil || result == nil {
-				respMsg := typedefs.TcpMessage{
-					Sub:       "ERROR",
-					Msg:       []byte(fmt.Sprintf("{\"error\": \"%v\"}", err)),
-					RequestId: requestid,
-				}
-				err := writer.WriteMessage(&respMsg)
-				if err != nil {
-					log.Printf("Error writing to TCP server: %v", err)
-
-				}
-				log.Printf("Response sent")
-				continue
-			}
-			respmsg := typedefs.TcpMessage{
-				Sub:       "RESPONSE",
-				Msg:       result,
-				RequestId: requestid,
-			}
-			err = writer.WriteMessage(&respmsg)
-			if err != nil {
-				log.Printf("Error writing to TCP server: %v", err)
-			}
-			log.Printf("Response sent")
-		case "TASK":
-			log.Printf("Received task: %v", response.Msg)
-		case "REG_RESPONSE":
-			log.Printf("Received registration response: %v", response.Msg)
-		default:
-			log.Printf("Unknown response type: %s", response.Sub)
-		}
+		}()
 	}
-}
 
-// Callback for /stocks
-func stocksCallback(req typedefs.Request) interface{} {
-	// Simulate a database query to retrieve stock data
-	stockData := []map[string]interface{}{
-		{"symbol": "AAPL", "price": 150.0},
-		{"symbol": "GOOG", "price": 2500.0},
-		{"symbol": "AMZN", "price": 3000.0},
+	// Register using HTTP
+	if err := w.RegisterHTTP(); err != nil {
+		slog.Warn("HTTP registration failed", "error", err)
 	}
 
-	return stockData
-}
-
-// Callback for /weather
-func weatherCallback(req typedefs.Request) interface{} {
-	// Simulate a weather API call to retrieve current weather conditions
-	weatherData := map[string]interface{}{
-		"temperature": 75.0,
-		"humidity":    60.0,
-		"conditions":  "Sunny",
+	// Register using gRPC
+	if err := w.RegisterGRPC(); err != nil {
+		slog.Warn("gRPC registration failed", "error", err)
 	}
 
-	return weatherData
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-// Callback for /crypto
-func cryptoCallback(req typedefs.Request) interface{} {
-	// Simulate a cryptocurrency API call to retrieve current prices
-	cryptoData := []map[string]interface{}{
-		{"symbol": "BTC", "price": 50000.0},
-		{"symbol": "ETH", "price": 4000.0},
-		{"symbol": "LTC", "price": 200.0},
+	// Connect via TCP and serve until interrupted
+	if err := w.Run(ctx); err != nil {
+		logging.Fatal("Worker stopped", "error", err)
 	}
-
-	return cryptoData
+	slog.Info("Worker stopped")
 }
 
-func ollamaCallback(req typedefs.Request) interface{} {
-	// Simulate a cryptocurrency API call to retrieve current prices
-
-	url := "http://192.168.1.10:11435/api/generate"
-	method := "POST"
-
-	payload := strings.NewReader(` {
-    "model": "mistral:latest",
-    "prompt": "best 10 country to live in ",
-    "stream":false
-}
-`)
-
-	client := &http.Client{}
-	reqllama, err := http.NewRequest(method, url, payload)
-
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	reqllama.Header.Add("Content-Type", "application/json")
-
-	res, err := client.Do(reqllama)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		fmt.Println(err)
-		return err
+// getenv returns the environment variable key, or fallback when it is unset.
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-	fmt.Println(string(body))
-	return string(body)
+	return fallback
 }
@@ -0,0 +1,265 @@
+// Package logging configures the structured logging of the gateway and
+// workers: log/slog records in text or JSON, a level that can be changed
+// while running, and redaction of credentials.
+//
+//	level, err := logging.Setup("json", "info")
+//	http.Handle("/admin/log-level", logging.LevelHandler(level))
+//	slog.Info("Request sent", logging.RequestID, id, logging.Headers(r.Header))
+package logging
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attribute keys shared by the gateway and workers, so records about the
+// same request can be joined across both.
+const (
+	ClientID   = "client_id"
+	Path       = "path"
+	RequestID  = "request_id"
+	RemoteAddr = "remote_addr"
+	Duration   = "duration"
+	// CorrelationID is the caller's own X-Request-Id, logged next to
+	// RequestID when it differs
+	CorrelationID = "correlation_id"
+)
+
+// Redacted replaces the values of sensitive attributes and headers.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys and header names, lowercased, whose
+// values are never logged.
+var sensitiveKeys = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+	"api_key":             true,
+	"token":               true,
+	"access_token":        true,
+	"refresh_token":       true,
+	"signature":           true,
+}
+
+// Sensitive reports whether values under key, an attribute key or header
+// name, must not be logged: credentials, cookies and anything named like a
+// password or secret.
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	return sensitiveKeys[key] || strings.Contains(key, "password") ||
+		strings.Contains(key, "passwd") || strings.Contains(key, "secret")
+}
+
+// ParseLevel parses debug, info, warn or error, in any case, optionally
+// with an offset such as "info+2".
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: use debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// NewHandler returns a handler writing to w in format, "text" or "json",
+// that drops records below level and redacts sensitive attributes.
+func NewHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q: use text or json", format)
+}
+
+// Setup makes a logger writing to stderr in format at level the default
+// for both slog and the log package, and returns its level for changing at
+// run time.
+func Setup(format, level string) (*slog.LevelVar, error) {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	levelVar := new(slog.LevelVar)
+	levelVar.Set(parsed)
+	handler, err := NewHandler(os.Stderr, format, levelVar)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(slog.New(handler))
+	return levelVar, nil
+}
+
+// redact is the ReplaceAttr hook of NewHandler.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if Sensitive(a.Key) && a.Value.Kind() != slog.KindGroup {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// headers logs a header map as a group, with sensitive values redacted.
+type headers map[string][]string
+
+// Headers returns an attribute logging h under "headers". Sensitive
+// headers are redacted even by handlers other than NewHandler's.
+func Headers(h map[string][]string) slog.Attr {
+	return slog.Any("headers", headers(h))
+}
+
+func (h headers) LogValue() slog.Value {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(h[name], ", ")
+		if Sensitive(name) {
+			value = Redacted
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// URL returns raw with the password of its user info and the values of
+// sensitive query parameters redacted, for logging URLs callers supplied.
+// Unparsable URLs are returned as they are.
+func URL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), Redacted)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		changed := false
+		for key := range query {
+			if Sensitive(key) {
+				query[key] = []string{Redacted}
+				changed = true
+			}
+		}
+		if changed {
+			u.RawQuery = query.Encode()
+		}
+	}
+	return u.String()
+}
+
+// Transport is an http.RoundTripper logging outgoing requests: at debug
+// level with their status and duration, or at warn level when they fail.
+// The request ID is taken from the X-Request-Id header.
+type Transport struct {
+	Base   http.RoundTripper // http.DefaultTransport if nil
+	Logger *slog.Logger      // slog.Default() if nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base, logger := t.Base, t.Logger
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	args := []any{"method", req.Method, "url", URL(req.URL.String()), Duration, time.Since(start)}
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		args = append(args, RequestID, id)
+	}
+	if err != nil {
+		logger.Warn("Outgoing request failed", append(args, "error", err)...)
+		return nil, err
+	}
+	logger.Debug("Outgoing request", append(args, "status", resp.StatusCode)...)
+	return resp, nil
+}
+
+// Fatal logs msg at error level with the default logger and exits with
+// status 1, like log.Fatal.
+func Fatal(msg string, args ...any) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:]) // the caller of Fatal
+	record := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	record.Add(args...)
+	slog.Default().Handler().Handle(context.Background(), record)
+	os.Exit(1)
+}
+
+// RequireToken restricts h to requests with an "Authorization: Bearer
+// token" header, for admin endpoints. The caller's address proves nothing
+// behind a reverse proxy on the same host, so it is not trusted.
+func RequireToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// LevelHandler serves the current level of level as {"level":"INFO"} on
+// GET, and changes it on PUT or POST with a body of the same form or a
+// level query parameter.
+func LevelHandler(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut, http.MethodPost:
+			requested := r.URL.Query().Get("level")
+			if requested == "" {
+				var body struct {
+					Level string `json:"level"`
+				}
+				if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&body); err != nil {
+					http.Error(w, `expected {"level": "debug|info|warn|error"}`, http.StatusBadRequest)
+					return
+				}
+				requested = body.Level
+			}
+			parsed, err := ParseLevel(requested)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if previous := level.Level(); previous != parsed {
+				level.Set(parsed)
+				slog.Warn("Log level changed", "from", previous.String(), "to", parsed.String(),
+					RemoteAddr, r.RemoteAddr)
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"level": level.Level().String()})
+	})
+}
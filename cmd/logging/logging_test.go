@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	level := new(slog.LevelVar)
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		remoteAddr    string
+		want          int
+	}{
+		{"valid token", "s3cret", "Bearer s3cret", "203.0.113.7:1234", http.StatusOK},
+		{"no token", "s3cret", "", "203.0.113.7:1234", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", "203.0.113.7:1234", http.StatusUnauthorized},
+		{"token prefix", "s3cret", "Bearer s3c", "203.0.113.7:1234", http.StatusUnauthorized},
+		{"not a bearer token", "s3cret", "Basic s3cret", "203.0.113.7:1234", http.StatusUnauthorized},
+		// A reverse proxy on the same host makes callers look local
+		{"loopback without token", "s3cret", "", "127.0.0.1:1234", http.StatusUnauthorized},
+		{"no token configured", "", "Bearer ", "127.0.0.1:1234", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := RequireToken(tt.token, LevelHandler(level))
+			r := httptest.NewRequest(http.MethodPut, "/admin/log-level", strings.NewReader(`{"level":"debug"}`))
+			r.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			level.Set(slog.LevelInfo)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			changed := level.Level() == slog.LevelDebug
+			if changed != (tt.want == http.StatusOK) {
+				t.Errorf("level changed: %v", changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+// Package metrics implements the counters, gauges and histograms the gateway
+// and workers export, and serves them in the Prometheus text exposition
+// format.
+//
+//	registry := metrics.NewRegistry()
+//	requests := registry.NewCounterVec("app_requests_total", "Requests served.", "path")
+//	requests.With("/stocks").Inc()
+//	http.Handle("/metrics", registry)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Registry holds metric families and writes them in registration order.
+// It is an http.Handler serving the text format.
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) add(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, f := range families {
+		f.write(buf)
+	}
+	err := buf.Flush()
+	return counter.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec holds the series of a family, keyed by their label values.
+type vec[T any] struct {
+	name, help, typ string
+	labels          []string
+	newSeries       func() *T
+
+	mu     sync.RWMutex
+	series map[string]*T
+	values map[string][]string
+}
+
+func newVec[T any](name, help, typ string, labels []string, newSeries func() *T) *vec[T] {
+	return &vec[T]{
+		name:      name,
+		help:      help,
+		typ:       typ,
+		labels:    labels,
+		newSeries: newSeries,
+		series:    make(map[string]*T),
+		values:    make(map[string][]string),
+	}
+}
+
+// with returns the series for labelValues, creating it on first use.
+func (v *vec[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	s = v.newSeries()
+	v.series[key] = s
+	v.values[key] = append([]string(nil), labelValues...)
+	return s
+}
+
+// each calls fn for every series, ordered by label values.
+func (v *vec[T]) each(fn func(labelValues []string, s *T)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		v.mu.RLock()
+		s, values := v.series[key], v.values[key]
+		v.mu.RUnlock()
+		fn(values, s)
+	}
+}
+
+func (v *vec[T]) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escape(v.help, false), v.name, v.typ)
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) load() float64 { return math.Float64frombits(v.bits.Load()) }
+
+// Counter is a value that only goes up.
+type Counter struct{ v value }
+
+// Inc adds one.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add adds delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.v.add(delta)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() float64 { return c.v.load() }
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ v value }
+
+func (g *Gauge) Inc()              { g.v.add(1) }
+func (g *Gauge) Dec()              { g.v.add(-1) }
+func (g *Gauge) Add(delta float64) { g.v.add(delta) }
+func (g *Gauge) Set(x float64)     { g.v.bits.Store(math.Float64bits(x)) }
+func (g *Gauge) Value() float64    { return g.v.load() }
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct{ v *vec[Counter] }
+
+// NewCounterVec registers a counter family. Without labels, it has a
+// single series, With().
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return new(Counter) })}
+	r.add(name, c)
+	return c
+}
+
+// With returns the counter for the label values, in the order the labels
+// were declared.
+func (c *CounterVec) With(labelValues ...string) *Counter { return c.v.with(labelValues) }
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.v.writeHeader(w)
+	c.v.each(func(values []string, s *Counter) {
+		writeSample(w, c.v.name, c.v.labels, values, "", "", s.Value())
+	})
+}
+
+// GaugeVec is a family of gauges partitioned by labels.
+type GaugeVec struct{ v *vec[Gauge] }
+
+// NewGaugeVec registers a gauge family.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return new(Gauge) })}
+	r.add(name, g)
+	return g
+}
+
+// With returns the gauge for the label values.
+func (g *GaugeVec) With(labelValues ...string) *Gauge { return g.v.with(labelValues) }
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.v.writeHeader(w)
+	g.v.each(func(values []string, s *Gauge) {
+		writeSample(w, g.v.name, g.v.labels, values, "", "", s.Value())
+	})
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn at every
+// scrape, e.g. from state kept elsewhere.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.add(name, &gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, escape(g.help, false), g.name)
+	writeSample(w, g.name, nil, nil, "", "", g.fn())
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64 // per bucket, the last one is +Inf
+	sum    value
+}
+
+// Observe records x, in seconds for latency histograms.
+func (h *Histogram) Observe(x float64) {
+	i := sort.SearchFloat64s(h.upper, x)
+	h.counts[i].Add(1)
+	h.sum.add(x)
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	v       *vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper
+// bounds, which must be sorted. A +Inf bucket is added.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: unsorted buckets for " + name)
+	}
+	buckets = append([]float64(nil), buckets...)
+	h := &HistogramVec{buckets: buckets}
+	h.v = newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+	})
+	r.add(name, h)
+	return h
+}
+
+// With returns the histogram for the label values.
+func (h *HistogramVec) With(labelValues ...string) *Histogram { return h.v.with(labelValues) }
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.v.writeHeader(w)
+	h.v.each(func(values []string, s *Histogram) {
+		var cumulative uint64
+		for i := range s.counts {
+			cumulative += s.counts[i].Load()
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			writeSample(w, h.v.name+"_bucket", h.v.labels, values, "le", le, float64(cumulative))
+		}
+		writeSample(w, h.v.name+"_sum", h.v.labels, values, "", "", s.sum.load())
+		writeSample(w, h.v.name+"_count", h.v.labels, values, "", "", float64(cumulative))
+	})
+}
+
+// writeSample writes one sample line, with an optional extra label such as
+// a histogram's le.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, x float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escape(values[i], true))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(x))
+	w.WriteByte('\n')
+}
+
+func formatFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	case math.IsNaN(x):
+		return "NaN"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+// escape escapes backslashes and newlines, and in label values also double
+// quotes.
+func escape(s string, quotes bool) string {
+	if !strings.ContainsAny(s, "\\\n\"") {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '"' && quotes:
+			b.WriteString(`\"`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// StatusClass returns the class label of an HTTP status code, such as "2xx".
+func StatusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// Conn counts the bytes read from and written to a connection.
+type Conn struct {
+	net.Conn
+	In, Out *Counter
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.In.Add(float64(n))
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.Out.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,198 @@
+// Package tlsconfig builds the TLS configurations of the gateway's TCP and
+// gRPC listeners and of workers, from PEM files that are reloaded when they
+// change on disk, so certificates can be rotated without a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files names the PEM files of a TLS endpoint. CAFile holds the CAs that
+// verify the peer: client certificates on the gateway, the gateway's
+// certificate on workers. Any of them may be empty.
+type Files struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// Reloader holds the certificate and CA pool loaded from Files and reloads
+// them when Watch sees the files change. Handshakes always use the current
+// ones; a failed reload keeps the previous ones.
+type Reloader struct {
+	files Files
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes [3]time.Time
+}
+
+// NewReloader loads files. CertFile and KeyFile must be given together.
+func NewReloader(files Files) (*Reloader, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("tls: certificate and key must be given together")
+	}
+	r := &Reloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again.
+func (r *Reloader) Reload() error {
+	modTimes := r.stat()
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: loading certificate: %w", err)
+		}
+		cert = &pair
+	}
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls: loading CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates in %s", r.files.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch checks the files every interval until stop is closed and reloads
+// them when one was modified.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r.mu.RLock()
+		unchanged := r.stat() == r.modTimes
+		r.mu.RUnlock()
+		if unchanged {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			slog.Warn("Keeping previous TLS certificates", "error", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificates", "cert_file", r.files.CertFile)
+	}
+}
+
+func (r *Reloader) stat() [3]time.Time {
+	var modTimes [3]time.Time
+	for i, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+// ServerConfig returns the configuration of a listener. With a CAFile,
+// client certificates are verified against it and, if requireClientCert is
+// set, demanded. The peer's identity is then available through PeerSubject.
+func (r *Reloader) ServerConfig(requireClientCert bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			if cert == nil {
+				return nil, errors.New("tls: no server certificate configured")
+			}
+			return cert, nil
+		},
+	}
+	if r.files.CAFile == "" {
+		return config
+	}
+	// Client certificates are verified here rather than by crypto/tls, so a
+	// reloaded CA applies to the next handshake
+	config.ClientAuth = tls.RequestClientCert
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		_, pool := r.current()
+		return verify(state.PeerCertificates, pool, x509.ExtKeyUsageClientAuth)
+	}
+	return config
+}
+
+// ClientConfig returns the configuration for dialing serverName, presenting
+// the certificate if one is configured. The CA pool is the one loaded at the
+// time of the call, or the system roots without a CAFile; the certificate is
+// read at every handshake.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	_, pool := r.current()
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    pool,
+	}
+	if r.files.CertFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	return config
+}
+
+func verify(chain []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage) error {
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		return fmt.Errorf("tls: verifying client certificate: %w", err)
+	}
+	return nil
+}
+
+// PeerSubject returns the common name of the verified client certificate
+// of a connection accepted with ServerConfig, or "" if the client sent none.
+func PeerSubject(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
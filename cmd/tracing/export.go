@@ -0,0 +1,255 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exportQueueSize = 4096
+	exportBatchSize = 512
+	exportInterval  = 2 * time.Second
+)
+
+// Exporter sends finished spans in batches as OTLP JSON
+// (ExportTraceServiceRequest) to a file, one request per line, or to an
+// OTLP/HTTP collector endpoint such as http://localhost:4318/v1/traces.
+// Spans are dropped, not waited for, when the exporter falls behind.
+type Exporter struct {
+	target string
+	send   func(body []byte) error
+
+	queue   chan *Span
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// NewExporter starts an exporter for target: an http:// or https:// URL of a
+// collector, or the path of a file to append to.
+func NewExporter(target string) (*Exporter, error) {
+	e := &Exporter{
+		target:  target,
+		queue:   make(chan *Span, exportQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		e.send = func(body []byte) error {
+			resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			io.Copy(io.Discard, resp.Body)
+			if resp.StatusCode/100 != 2 {
+				return fmt.Errorf("collector answered %s", resp.Status)
+			}
+			return nil
+		}
+	} else {
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: opening export file: %w", err)
+		}
+		e.send = func(body []byte) error {
+			_, err := file.Write(append(body, '\n'))
+			return err
+		}
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *Exporter) export(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Close exports the queued spans and stops the exporter.
+func (e *Exporter) Close() {
+	e.once.Do(func() { close(e.closing) })
+	<-e.done
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		e.mu.Lock()
+		dropped := e.dropped
+		e.dropped = 0
+		e.mu.Unlock()
+		if dropped > 0 {
+			slog.Warn("Tracing export is falling behind, dropped spans", "spans", dropped, "target", e.target)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		body, err := json.Marshal(encodeSpans(batch))
+		if err == nil {
+			err = e.send(body)
+		}
+		if err != nil {
+			slog.Warn("Tracing export failed", "spans", len(batch), "target", e.target, "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.closing:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// OTLP JSON encoding. IDs are hex strings and 64-bit integers decimal
+// strings, as the OTLP/HTTP JSON mapping requires.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		TraceState   string          `json:"traceState,omitempty"`
+		Name         string          `json:"name"`
+		Kind         SpanKind        `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+)
+
+func encodeSpans(spans []*Span) otlpRequest {
+	byService := make(map[string][]otlpSpan)
+	var services []string
+	for _, s := range spans {
+		service := s.tracer.service
+		if _, ok := byService[service]; !ok {
+			services = append(services, service)
+		}
+		byService[service] = append(byService[service], encodeSpan(s))
+	}
+	var req otlpRequest
+	for _, service := range services {
+		req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+			Resource: otlpResource{Attributes: []otlpAttribute{attribute("service.name", service)}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "multichannel"},
+				Spans: byService[service],
+			}},
+		})
+	}
+	return req
+}
+
+func encodeSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:    s.context.TraceID.String(),
+		SpanID:     s.context.SpanID.String(),
+		TraceState: s.context.TraceState,
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = s.parent.String()
+	}
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		span.Attributes = append(span.Attributes, attribute(key, s.attributes[key]))
+	}
+	if s.failed {
+		span.Status = &otlpStatus{Code: 2, Message: s.errMessage}
+	}
+	return span
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch x := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": x}
+	case bool:
+		v = map[string]interface{}{"boolValue": x}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case int32:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(int64(x), 10)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": x}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
@@ -0,0 +1,252 @@
+// Package tracing propagates W3C trace context (traceparent and tracestate)
+// across the gateway and workers and records spans, exported as OTLP JSON to
+// a file or an OTLP/HTTP collector.
+//
+// A nil *Tracer records nothing but still propagates: its spans carry the
+// parent's context, so traces started upstream continue downstream.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string // opaque vendor data, passed on unchanged
+}
+
+// IsValid reports whether sc has non-zero trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+var errInvalidTraceparent = errors.New("tracing: invalid traceparent")
+
+// ParseTraceparent parses traceparent and tracestate headers. Future
+// versions are accepted as long as they start with the version 00 fields.
+func ParseTraceparent(traceparent, tracestate string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) ||
+		!isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(flags, 2) {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	var sc SpanContext
+	hex.Decode(sc.TraceID[:], []byte(traceID))
+	hex.Decode(sc.SpanID[:], []byte(spanID))
+	if !sc.IsValid() {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	var flagBits [1]byte
+	hex.Decode(flagBits[:], []byte(flags))
+	sc.Sampled = flagBits[0]&1 == 1
+	sc.TraceState = strings.TrimSpace(tracestate)
+	return sc, nil
+}
+
+// isHex reports whether s is n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// SpanKind is the role of a span, as in OTLP.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Tracer starts spans and hands finished ones to an Exporter.
+type Tracer struct {
+	service     string
+	exporter    *Exporter
+	sampleRatio float64
+}
+
+// NewTracer returns a tracer for a service. Spans continuing a trace follow
+// the caller's sampling decision; new traces are sampled with probability
+// sampleRatio.
+func NewTracer(service string, exporter *Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{service: service, exporter: exporter, sampleRatio: sampleRatio}
+}
+
+// Start starts a span as a child of parent, or as the root of a new trace
+// when parent is not valid. With a nil Tracer, or when the trace is not
+// sampled, the span records nothing; with a nil Tracer its context is
+// parent's.
+func (t *Tracer) Start(parent SpanContext, name string, kind SpanKind) *Span {
+	if t == nil {
+		return &Span{context: parent}
+	}
+	sc := SpanContext{
+		TraceID:    parent.TraceID,
+		Sampled:    parent.Sampled,
+		TraceState: parent.TraceState,
+	}
+	if !parent.IsValid() {
+		sc.TraceID = newTraceID()
+		sc.Sampled = sample(t.sampleRatio)
+	}
+	sc.SpanID = newSpanID()
+	span := &Span{context: sc}
+	if sc.Sampled {
+		span.tracer = t
+		span.name = name
+		span.kind = kind
+		span.parent = parent.SpanID
+		span.start = time.Now()
+	}
+	return span
+}
+
+func sample(ratio float64) bool {
+	switch {
+	case ratio >= 1:
+		return true
+	case ratio <= 0:
+		return false
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < ratio
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// Span is an operation being timed. Its methods are safe for concurrent
+// use and do nothing on spans that are not recorded.
+type Span struct {
+	context SpanContext
+	tracer  *Tracer // nil if not recording
+
+	name   string
+	kind   SpanKind
+	parent SpanID
+	start  time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	errMessage string
+	failed     bool
+}
+
+// Context returns the span's context, to be propagated to children.
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// Recording reports whether the span will be exported.
+func (s *Span) Recording() bool {
+	return s.tracer != nil
+}
+
+// SetAttribute sets an attribute; value should be a string, bool, integer
+// or float.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errMessage = message
+}
+
+// End finishes the span and queues it for export. Only the first call
+// counts.
+func (s *Span) End() {
+	if s.tracer == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.tracer.exporter != nil {
+		s.tracer.exporter.export(s)
+	}
+}
+
+// Duration returns how long the span ran, or has been running so far.
+func (s *Span) Duration() time.Duration {
+	if s.tracer == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		return time.Since(s.start)
+	}
+	return s.end.Sub(s.start)
+}
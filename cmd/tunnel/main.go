@@ -0,0 +1,120 @@
+// Command tunnel exposes a local HTTP service through the gateway. It
+// registers a set of paths as a worker and forwards every request to the
+// upstream URL, relaying the response back.
+//
+//	go run ./cmd/tunnel -upstream http://localhost:3000 -paths "/app/*" -strip-prefix /app
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"multichannel/cmd/callbacks"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/tlsconfig"
+	"multichannel/cmd/tracing"
+	"multichannel/http/lib"
+	"multichannel/worker"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	upstream := flag.String("upstream", "", "base URL of the local service to expose, e.g. http://localhost:3000")
+	paths := flag.String("paths", "/*", "comma-separated route patterns to register with the gateway")
+	stripPrefix := flag.String("strip-prefix", "", "path prefix removed before forwarding upstream")
+	hostHeader := flag.String("host-header", "", "Host header sent upstream (default: the upstream's host)")
+	preserveHost := flag.Bool("preserve-host", false, "send the Host header the caller used instead of the upstream's")
+	timeout := flag.Duration("timeout", 0, "timeout for each upstream request (0 for none)")
+	host := flag.String("gateway", "localhost", "gateway host")
+	tcpPort := flag.Int("tcp-port", 8081, "gateway TCP port")
+	clientId := flag.String("client-id", "", "client ID to register with (default: random)")
+	maxConcurrency := flag.Int("max-concurrency", 16, "requests forwarded upstream at the same time")
+	token := flag.String("token", os.Getenv("MULTICHANNEL_TOKEN"), "pre-shared token from the gateway's auth policy")
+	keyId := flag.String("key-id", "", "auth policy credential name; with -secret the token is replaced by an HMAC signature")
+	secret := flag.String("secret", os.Getenv("MULTICHANNEL_SECRET"), "HMAC secret of the -key-id credential")
+	var tlsFiles tlsconfig.Files
+	flag.StringVar(&tlsFiles.CAFile, "tls-ca", "", "PEM CAs verifying the gateway (enables TLS; empty with -tls uses the system roots)")
+	flag.StringVar(&tlsFiles.CertFile, "tls-cert", "", "PEM client certificate identifying the worker")
+	flag.StringVar(&tlsFiles.KeyFile, "tls-key", "", "PEM private key of -tls-cert")
+	useTLS := flag.Bool("tls", false, "connect to the gateway over TLS")
+	traceExport := flag.String("trace-export", "", "OTLP/HTTP traces URL or file to write callback spans to (default: none)")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. :9100 (default: none)")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	flag.Parse()
+
+	if _, err := logging.Setup(*logFormat, *logLevel); err != nil {
+		logging.Fatal("Invalid log configuration", "error", err)
+	}
+
+	target, err := url.Parse(*upstream)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		logging.Fatal("Invalid -upstream: want an absolute URL such as http://localhost:3000", "upstream", *upstream)
+	}
+
+	opts := []worker.Option{
+		worker.WithHost(*host),
+		worker.WithTCPPort(*tcpPort),
+		worker.WithMaxConcurrency(*maxConcurrency),
+	}
+	if *clientId != "" {
+		opts = append(opts, worker.WithClientID(*clientId))
+	}
+	if *useTLS || tlsFiles != (tlsconfig.Files{}) {
+		reloader, err := tlsconfig.NewReloader(tlsFiles)
+		if err != nil {
+			logging.Fatal("Invalid TLS configuration", "error", err)
+		}
+		go reloader.Watch(30*time.Second, nil)
+		opts = append(opts, worker.WithTLS(reloader.ClientConfig("")))
+	}
+	if *secret != "" {
+		opts = append(opts, worker.WithHMAC(*keyId, []byte(*secret)))
+	} else if *token != "" {
+		opts = append(opts, worker.WithToken(*token))
+	}
+	if *traceExport != "" {
+		exporter, err := tracing.NewExporter(*traceExport)
+		if err != nil {
+			logging.Fatal("Invalid -trace-export", "error", err)
+		}
+		defer exporter.Close()
+		opts = append(opts, worker.WithTracer(tracing.NewTracer("multichannel-tunnel", exporter, 1)))
+	}
+	w := worker.New(opts...)
+
+	proxy := callbacks.Proxy(callbacks.ProxyConfig{
+		Upstream:     target,
+		StripPrefix:  *stripPrefix,
+		Host:         *hostHeader,
+		PreserveHost: *preserveHost,
+		Client:       lib.NewProxyHttpClient(*timeout),
+	})
+	for _, pattern := range strings.Split(*paths, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			w.Handle(pattern, proxy)
+		}
+	}
+	slog.Info("Forwarding", "paths", w.Paths(), "upstream", logging.URL(target.String()))
+	if *metricsAddr != "" {
+		go func() {
+			slog.Info("Serving metrics", "addr", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, w.Metrics()); err != nil {
+				slog.Error("Metrics server failed", "addr", *metricsAddr, "error", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := w.Run(ctx); err != nil {
+		logging.Fatal("Tunnel stopped", "error", err)
+	}
+	slog.Info("Tunnel stopped")
+}
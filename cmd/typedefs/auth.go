@@ -0,0 +1,66 @@
+package typedefs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Auth is the credential a worker presents in the "auth" field of REG. With
+// a pre-shared token it sends Token; with an HMAC secret it sends Signature,
+// computed by SignChallenge over the challenge from WELCOME. KeyID names the
+// credential in the gateway's policy and is required for signatures.
+type Auth struct {
+	KeyID     string `json:"key_id,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// NewChallenge returns a random nonce for the WELCOME frame.
+func NewChallenge() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// SignChallenge answers a WELCOME challenge: the hex HMAC-SHA256 of the
+// challenge and the client ID under secret. Binding the client ID keeps a
+// captured signature from registering under another ID.
+func SignChallenge(secret []byte, challenge, clientId string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(challenge + ":" + clientId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Rejection codes sent in REG_REJECTED.
+const (
+	// RejectUnauthenticated means the credential is missing or wrong.
+	RejectUnauthenticated = "unauthenticated"
+	// RejectForbiddenPath means the credential may not claim some paths.
+	RejectForbiddenPath = "forbidden_path"
+	// RejectClientIdInUse means another credential's worker is registered
+	// with the same client ID.
+	RejectClientIdInUse = "client_id_in_use"
+)
+
+// Rejection is the payload of the REG_REJECTED frame the gateway sends
+// before closing a connection whose registration it denied.
+type Rejection struct {
+	Code   string   `json:"code"`
+	Reason string   `json:"reason"`
+	Paths  []string `json:"paths,omitempty"` // denied paths for RejectForbiddenPath
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("registration rejected (%s): %s", r.Code, r.Reason)
+}
+
+// Temporary reports whether registering again later may succeed without a
+// configuration change.
+func (r *Rejection) Temporary() bool {
+	return r.Code == RejectClientIdInUse
+}
@@ -0,0 +1,62 @@
+package typedefs
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewChallenge(t *testing.T) {
+	a, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := hex.DecodeString(a); err != nil || len(raw) != 16 {
+		t.Errorf("got challenge %q, want 16 hex encoded bytes", a)
+	}
+	if a == b {
+		t.Errorf("two challenges were both %q", a)
+	}
+}
+
+func TestSignChallenge(t *testing.T) {
+	want := SignChallenge([]byte("secret"), "c0ffee", "worker-1")
+	if got := SignChallenge([]byte("secret"), "c0ffee", "worker-1"); got != want {
+		t.Errorf("signature is not deterministic: %q and %q", got, want)
+	}
+	if raw, err := hex.DecodeString(want); err != nil || len(raw) != 32 {
+		t.Errorf("got signature %q, want a hex encoded SHA-256 HMAC", want)
+	}
+	tests := []struct {
+		name      string
+		secret    string
+		challenge string
+		clientId  string
+	}{
+		{"other secret", "guess", "c0ffee", "worker-1"},
+		{"other challenge", "secret", "0ld", "worker-1"},
+		{"other client ID", "secret", "c0ffee", "worker-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SignChallenge([]byte(tt.secret), tt.challenge, tt.clientId); got == want {
+				t.Errorf("signature %q also answers the original challenge", got)
+			}
+		})
+	}
+}
+
+func TestRejectionTemporary(t *testing.T) {
+	for code, want := range map[string]bool{
+		RejectUnauthenticated: false,
+		RejectForbiddenPath:   false,
+		RejectClientIdInUse:   true,
+	} {
+		if got := (&Rejection{Code: code}).Temporary(); got != want {
+			t.Errorf("%s: got Temporary %v, want %v", code, got, want)
+		}
+	}
+}
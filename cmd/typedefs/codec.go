@@ -0,0 +1,421 @@
+package typedefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	conversion "multichannel/cmd/protos"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes TcpMessage frames and the Request and Response payloads of
+// REQUEST, RESPONSE and ERROR frames. The codec of every frame is recorded in
+// its header, so a reader decodes frames of any codec; the codec a peer
+// writes with is negotiated in the WELCOME/REG handshake.
+type Codec interface {
+	Name() string
+	// ID is the value stored in the codec byte of the frame header.
+	ID() byte
+
+	Marshal(message *TcpMessage) ([]byte, error)
+	Unmarshal(data []byte, message *TcpMessage) error
+	MarshalRequest(request *Request) ([]byte, error)
+	UnmarshalRequest(data []byte, request *Request) error
+	MarshalResponse(response *Response) ([]byte, error)
+	UnmarshalResponse(data []byte, response *Response) error
+}
+
+var (
+	// JSONCodec is the original encoding and the default until a peer
+	// negotiates another codec.
+	JSONCodec Codec = jsonCodec{}
+	// ProtobufCodec carries payloads as conversion.HttpRequest and
+	// conversion.HttpResponse messages without base64-inflating bodies.
+	ProtobufCodec Codec = protobufCodec{}
+
+	// codecs lists the supported codecs in order of preference.
+	codecs = []Codec{ProtobufCodec, JSONCodec}
+)
+
+var ErrUnknownCodec = errors.New("frame: unknown codec")
+
+// errNotResponse is returned by UnmarshalResponse for JSON payloads without
+// a status_code, which the Response envelope always has: the bare JSON
+// bodies sent by workers that predate it.
+var errNotResponse = errors.New("payload is not a response envelope")
+
+// CodecNames returns the names of the supported codecs, most preferred
+// first. The gateway offers them in its WELCOME frame.
+func CodecNames() []string {
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.Name()
+	}
+	return names
+}
+
+// CodecByName looks up a codec by the name used in the handshake.
+func CodecByName(name string) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+func codecByID(id byte) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.ID() == id {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// Welcome is the payload of the WELCOME frame. Gateways that predate codec
+// negotiation send a plain text message instead, which means JSON only.
+type Welcome struct {
+	Message string   `json:"message"`
+	Codecs  []string `json:"codecs,omitempty"`
+	// Challenge is signed by workers that authenticate with an HMAC secret.
+	Challenge string `json:"challenge,omitempty"`
+	// FlowControl offers WINDOW based flow control of streamed bodies,
+	// which workers accept with "flow_control" in REG.
+	FlowControl bool `json:"flow_control,omitempty"`
+}
+
+// NegotiateCodec picks the codec to use with a gateway from its WELCOME
+// payload. preferred is used when the gateway offers it, JSON otherwise.
+func NegotiateCodec(welcome []byte, preferred string) Codec {
+	var hello Welcome
+	if err := json.Unmarshal(welcome, &hello); err != nil {
+		return JSONCodec
+	}
+	for _, name := range hello.Codecs {
+		if name == preferred {
+			if codec, ok := CodecByName(name); ok {
+				return codec
+			}
+		}
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) ID() byte     { return 0 }
+
+func (jsonCodec) Marshal(message *TcpMessage) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Unmarshal(data []byte, message *TcpMessage) error {
+	return json.Unmarshal(data, message)
+}
+
+func (jsonCodec) MarshalRequest(request *Request) ([]byte, error) {
+	return json.Marshal(request)
+}
+
+func (jsonCodec) UnmarshalRequest(data []byte, request *Request) error {
+	return json.Unmarshal(data, request)
+}
+
+func (jsonCodec) MarshalResponse(response *Response) ([]byte, error) {
+	return json.Marshal(response)
+}
+
+func (jsonCodec) UnmarshalResponse(data []byte, response *Response) error {
+	// The outer StatusCode shadows the embedded one, telling a zero status
+	// from a missing one
+	type fields Response
+	var envelope struct {
+		StatusCode *int32 `json:"status_code"`
+		fields
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	if envelope.StatusCode == nil {
+		return errNotResponse
+	}
+	*response = Response(envelope.fields)
+	response.StatusCode = *envelope.StatusCode
+	return nil
+}
+
+// protobufCodec encodes the TcpMessage envelope as
+//
+//	message TcpMessage {
+//	  string sub = 1;
+//	  bytes msg = 2;
+//	  reserved 3; // int32 request IDs of earlier versions
+//	  string request = 4;
+//	}
+//
+// and payloads as conversion.HttpRequest and conversion.HttpResponse. Fields
+// those messages lack travel as pseudo-headers: ":stream" marks a streamed
+// body, ":route" carries the matched route pattern, ":authority", ":scheme",
+// ":proto" and ":remote" carry the host, scheme, protocol and client address,
+// ":tls" the JSON-encoded TLSInfo, ":traceparent" and ":tracestate" the
+// trace context, ":duration" a response's Duration in
+// nanoseconds, and repeated header values are joined with
+// newlines, which cannot appear in a header value. The query string is
+// appended to Url. Path parameters are not sent; workers extract them from
+// the route.
+type protobufCodec struct{}
+
+const (
+	streamPseudoHeader      = ":stream"
+	routePseudoHeader       = ":route"
+	authorityPseudoHeader   = ":authority"
+	schemePseudoHeader      = ":scheme"
+	protoPseudoHeader       = ":proto"
+	remotePseudoHeader      = ":remote"
+	tlsPseudoHeader         = ":tls"
+	durationPseudoHeader    = ":duration"
+	traceParentPseudoHeader = ":traceparent"
+	traceStatePseudoHeader  = ":tracestate"
+	headerValueSep          = "\n"
+)
+
+func (protobufCodec) Name() string { return "protobuf" }
+func (protobufCodec) ID() byte     { return 1 }
+
+func (protobufCodec) Marshal(message *TcpMessage) ([]byte, error) {
+	b := make([]byte, 0, len(message.Sub)+len(message.Msg)+16)
+	if message.Sub != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, message.Sub)
+	}
+	if len(message.Msg) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, message.Msg)
+	}
+	if message.RequestId != "" {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, message.RequestId)
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, message *TcpMessage) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			message.Sub = v
+			data = data[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			message.Msg = append([]byte(nil), v...)
+			data = data[n:]
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			message.RequestId = v
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+func (protobufCodec) MarshalRequest(request *Request) ([]byte, error) {
+	headers := make(map[string]string, len(request.Headers)+9)
+	for key, values := range request.Headers {
+		headers[key] = strings.Join(values, headerValueSep)
+	}
+	if request.Stream {
+		headers[streamPseudoHeader] = "1"
+	}
+	if request.Route != "" {
+		headers[routePseudoHeader] = request.Route
+	}
+	if request.Host != "" {
+		headers[authorityPseudoHeader] = request.Host
+	}
+	if request.Scheme != "" {
+		headers[schemePseudoHeader] = request.Scheme
+	}
+	if request.Proto != "" {
+		headers[protoPseudoHeader] = request.Proto
+	}
+	if request.RemoteAddr != "" {
+		headers[remotePseudoHeader] = request.RemoteAddr
+	}
+	if request.TLS != nil {
+		info, err := json.Marshal(request.TLS)
+		if err != nil {
+			return nil, err
+		}
+		headers[tlsPseudoHeader] = string(info)
+	}
+	if request.Trace != nil {
+		headers[traceParentPseudoHeader] = request.Trace.TraceParent
+		if request.Trace.TraceState != "" {
+			headers[traceStatePseudoHeader] = request.Trace.TraceState
+		}
+	}
+	url := request.Path
+	if request.RawQuery != "" {
+		url += "?" + request.RawQuery
+	}
+	return proto.Marshal(&conversion.HttpRequest{
+		Method:  request.Method,
+		Url:     url,
+		Headers: headers,
+		Body:    request.Body,
+	})
+}
+
+func (protobufCodec) UnmarshalRequest(data []byte, request *Request) error {
+	var msg conversion.HttpRequest
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	request.Method = msg.Method
+	request.Path, request.RawQuery, _ = strings.Cut(msg.Url, "?")
+	request.Body = msg.Body
+	request.Headers = make(Headers, len(msg.Headers))
+	for key, value := range msg.Headers {
+		switch key {
+		case streamPseudoHeader:
+			request.Stream = true
+		case routePseudoHeader:
+			request.Route = value
+		case authorityPseudoHeader:
+			request.Host = value
+		case schemePseudoHeader:
+			request.Scheme = value
+		case protoPseudoHeader:
+			request.Proto = value
+		case remotePseudoHeader:
+			request.RemoteAddr = value
+		case tlsPseudoHeader:
+			request.TLS = new(TLSInfo)
+			if err := json.Unmarshal([]byte(value), request.TLS); err != nil {
+				return fmt.Errorf("%s pseudo-header: %w", tlsPseudoHeader, err)
+			}
+		case traceParentPseudoHeader, traceStatePseudoHeader:
+			if request.Trace == nil {
+				request.Trace = new(TraceContext)
+			}
+			if key == traceParentPseudoHeader {
+				request.Trace.TraceParent = value
+			} else {
+				request.Trace.TraceState = value
+			}
+		default:
+			request.Headers[key] = strings.Split(value, headerValueSep)
+		}
+	}
+	return nil
+}
+
+func (protobufCodec) MarshalResponse(response *Response) ([]byte, error) {
+	headers := make(map[string]string, len(response.Headers)+2)
+	for key, values := range response.Headers {
+		headers[key] = strings.Join(values, headerValueSep)
+	}
+	if response.Stream {
+		headers[streamPseudoHeader] = "1"
+	}
+	if response.Duration > 0 {
+		headers[durationPseudoHeader] = strconv.FormatInt(int64(response.Duration), 10)
+	}
+	return proto.Marshal(&conversion.HttpResponse{
+		StatusCode: response.StatusCode,
+		Headers:    headers,
+		Body:       response.Body,
+	})
+}
+
+func (protobufCodec) UnmarshalResponse(data []byte, response *Response) error {
+	var msg conversion.HttpResponse
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	response.StatusCode = msg.StatusCode
+	response.Body = msg.Body
+	response.Headers = make(Headers, len(msg.Headers))
+	for key, value := range msg.Headers {
+		switch key {
+		case streamPseudoHeader:
+			response.Stream = true
+		case durationPseudoHeader:
+			ns, _ := strconv.ParseInt(value, 10, 64)
+			response.Duration = time.Duration(ns)
+		default:
+			response.Headers[key] = strings.Split(value, headerValueSep)
+		}
+	}
+	return nil
+}
+
+// DecodeRequest decodes the payload of a REQUEST frame with the codec the
+// frame was written in.
+func (m *TcpMessage) DecodeRequest() (*Request, error) {
+	var request Request
+	if err := m.Codec().UnmarshalRequest(m.Msg, &request); err != nil {
+		return nil, fmt.Errorf("decoding %s request: %w", m.Codec().Name(), err)
+	}
+	if request.RequestId == "" {
+		request.RequestId = m.RequestId
+	}
+	return &request, nil
+}
+
+// DecodeResponse decodes the payload of a RESPONSE or ERROR frame with the
+// codec the frame was written in. Envelopes without a status code get the
+// given default status; payloads that do not decode as an envelope, from
+// workers that predate it, are treated as a JSON body with that status.
+func (m *TcpMessage) DecodeResponse(defaultStatus int) *Response {
+	var resp Response
+	if err := m.Codec().UnmarshalResponse(m.Msg, &resp); err == nil {
+		if resp.StatusCode == 0 {
+			resp.StatusCode = int32(defaultStatus)
+		}
+		return &resp
+	}
+	return &Response{
+		StatusCode: int32(defaultStatus),
+		Headers:    Headers{"Content-Type": {"application/json"}},
+		Body:       m.Msg,
+	}
+}
+
+// Codec returns the codec the message was read with; messages that were not
+// read from a connection report JSONCodec.
+func (m *TcpMessage) Codec() Codec {
+	if m.codec == nil {
+		return JSONCodec
+	}
+	return m.codec
+}
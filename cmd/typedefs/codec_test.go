@@ -0,0 +1,259 @@
+package typedefs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roundTrip writes message with codec and reads it back.
+func roundTrip(t *testing.T, codec Codec, write func(*TcpMessageWriter) error) *TcpMessage {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := NewTcpMessageWriter(&buf)
+	writer.SetCodec(codec)
+	if err := write(writer); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	message, err := NewTcpMessageReader(&buf).ReadMessage()
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if message.Codec() != codec {
+		t.Fatalf("read with codec %s, want %s", message.Codec().Name(), codec.Name())
+	}
+	return message
+}
+
+func TestCodecMessageRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			want := &TcpMessage{Sub: "RESPONSE_CHUNK", Msg: []byte("chunk\x00\xff"), RequestId: "01HZX4T3QK8V6N0J2M5R7W9Y1B"}
+			got := roundTrip(t, codec, func(w *TcpMessageWriter) error { return w.WriteMessage(want) })
+			if got.Sub != want.Sub || !bytes.Equal(got.Msg, want.Msg) || got.RequestId != want.RequestId {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecRequestRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			want := &Request{
+				RequestId:  "01HZX4T3QK8V6N0J2M5R7W9Y1B",
+				Method:     "POST",
+				Path:       "/items/42",
+				RawQuery:   "q=a+b&page=2",
+				Host:       "gateway.example.com",
+				Scheme:     "https",
+				Proto:      "HTTP/2.0",
+				RemoteAddr: "203.0.113.7",
+				TLS:        &TLSInfo{Version: "TLS 1.3", CipherSuite: "TLS_AES_128_GCM_SHA256", ServerName: "gateway.example.com"},
+				Trace: &TraceContext{
+					TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+					TraceState:  "vendor=1",
+				},
+				Headers: Headers{
+					"Accept":       {"text/html", "application/json"},
+					"Content-Type": {"application/json"},
+				},
+				Body:   []byte(`{"name":"widget"}`),
+				Stream: true,
+				Route:  "POST /items/{id}",
+				Params: map[string]string{"id": "42"},
+			}
+			message := roundTrip(t, codec, func(w *TcpMessageWriter) error { return w.WriteRequest(want) })
+			if message.Sub != "REQUEST" || message.RequestId != want.RequestId {
+				t.Fatalf("got frame %q for %q, want REQUEST for %q", message.Sub, message.RequestId, want.RequestId)
+			}
+			got, err := message.DecodeRequest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec == ProtobufCodec {
+				// Workers extract path parameters from the route
+				want.Params = nil
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecResponseRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			want := &Response{
+				StatusCode: 201,
+				Headers: Headers{
+					"Content-Type": {"text/plain"},
+					"Set-Cookie":   {"a=1", "b=2"},
+				},
+				Body:     []byte("created"),
+				Stream:   true,
+				Duration: 1500 * time.Microsecond,
+			}
+			message := roundTrip(t, codec, func(w *TcpMessageWriter) error {
+				return w.WriteResponse("RESPONSE", "01HZX4T3QK8V6N0J2M5R7W9Y1B", want)
+			})
+			got := message.DecodeResponse(200)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseWithoutStatus(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			message := roundTrip(t, codec, func(w *TcpMessageWriter) error {
+				return w.WriteResponse("RESPONSE", "01HZX4T3QK8V6N0J2M5R7W9Y1B", &Response{Body: []byte("hello"), Stream: true})
+			})
+			got := message.DecodeResponse(200)
+			want := &Response{StatusCode: 200, Headers: Headers{}, Body: []byte("hello"), Stream: true}
+			if codec == JSONCodec {
+				want.Headers = nil
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseLegacyPayload(t *testing.T) {
+	for _, payload := range []string{`{"error":"boom"}`, `{}`, `null`, `[1,2]`, `"boom"`, `{"body":"not base64!"}`} {
+		t.Run(payload, func(t *testing.T) {
+			message := &TcpMessage{Sub: "ERROR", Msg: []byte(payload)}
+			got := message.DecodeResponse(500)
+			if got.StatusCode != 500 || string(got.Body) != payload || got.Headers.Get("Content-Type") != "application/json" || got.Stream {
+				t.Errorf("got %+v", got)
+			}
+		})
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		name      string
+		welcome   string
+		preferred string
+		want      Codec
+	}{
+		{"offered", `{"message":"hi","codecs":["protobuf","json"]}`, "protobuf", ProtobufCodec},
+		{"json preferred", `{"message":"hi","codecs":["protobuf","json"]}`, "json", JSONCodec},
+		{"not offered", `{"message":"hi","codecs":["json"]}`, "protobuf", JSONCodec},
+		{"unknown codec", `{"message":"hi","codecs":["cbor"]}`, "cbor", JSONCodec},
+		{"plain text welcome", `Connected to TCP server`, "protobuf", JSONCodec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateCodec([]byte(tt.welcome), tt.preferred); got != tt.want {
+				t.Errorf("got %s, want %s", got.Name(), tt.want.Name())
+			}
+		})
+	}
+}
+
+func TestReadMessageUnknownCodec(t *testing.T) {
+	frame := []byte{FrameMagic0, FrameMagic1, FrameVersion, 9, 0, 0, 0, 2, '{', '}'}
+	_, err := NewTcpMessageReader(bytes.NewReader(frame)).ReadMessage()
+	if !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("got %v, want ErrUnknownCodec", err)
+	}
+}
+
+// benchmarkCodec encodes and decodes the frame written by write through a
+// TcpMessageWriter and TcpMessageReader with each codec, reporting the
+// frame size on the wire.
+func benchmarkCodec(b *testing.B, write func(*TcpMessageWriter) error, check func(*TcpMessage) error) {
+	for _, name := range CodecNames() {
+		codec, _ := CodecByName(name)
+		b.Run(name, func(b *testing.B) {
+			var wire bytes.Buffer
+			writer := NewTcpMessageWriter(&wire)
+			writer.SetCodec(codec)
+			if err := write(writer); err != nil {
+				b.Fatal(err)
+			}
+			size := wire.Len()
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wire.Reset()
+				if err := write(writer); err != nil {
+					b.Fatal(err)
+				}
+				message, err := NewTcpMessageReader(&wire).ReadMessage()
+				if err == nil {
+					err = check(message)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size), "wire-bytes")
+		})
+	}
+}
+
+var (
+	benchRequest = &Request{
+		RequestId: "01HZX4T3QK8V6N0J2M5R7W9Y1B",
+		Method:    "POST",
+		Path:      "/screenshot",
+		Headers:   Headers{"Content-Type": {"application/json"}, "User-Agent": {"codecbench"}},
+		Body:      []byte(`{"url":"https://example.com","width":1280,"height":800}`),
+	}
+	benchBody = func() []byte {
+		body := make([]byte, 256*1024)
+		rand.New(rand.NewSource(1)).Read(body)
+		return body
+	}()
+)
+
+func BenchmarkCodecRequest(b *testing.B) {
+	benchmarkCodec(b,
+		func(w *TcpMessageWriter) error { return w.WriteRequest(benchRequest) },
+		func(message *TcpMessage) error {
+			decoded, err := message.DecodeRequest()
+			if err == nil && decoded.RequestId != benchRequest.RequestId {
+				err = fmt.Errorf("request ID %q decoded as %q", benchRequest.RequestId, decoded.RequestId)
+			}
+			return err
+		})
+}
+
+func BenchmarkCodecResponse(b *testing.B) {
+	response := &Response{
+		StatusCode: 200,
+		Headers:    Headers{"Content-Type": {"image/png"}, "Set-Cookie": {"a=1", "b=2"}},
+		Body:       benchBody,
+	}
+	benchmarkCodec(b,
+		func(w *TcpMessageWriter) error {
+			return w.WriteResponse("RESPONSE", benchRequest.RequestId, response)
+		},
+		func(message *TcpMessage) error {
+			if decoded := message.DecodeResponse(500); len(decoded.Body) != len(benchBody) {
+				return fmt.Errorf("decoded %d body bytes, want %d", len(decoded.Body), len(benchBody))
+			}
+			return nil
+		})
+}
+
+func BenchmarkCodecResponseChunk(b *testing.B) {
+	benchmarkCodec(b,
+		func(w *TcpMessageWriter) error {
+			return w.WriteMessage(&TcpMessage{Sub: "RESPONSE_CHUNK", RequestId: benchRequest.RequestId, Msg: benchBody})
+		},
+		func(message *TcpMessage) error { return nil })
+}
@@ -0,0 +1,110 @@
+package typedefs
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// StreamWindow is the number of body chunks of one request a peer sends
+// before it waits for the receiver to grant more with a WINDOW frame. Flow
+// control is used on connections where the gateway offered it in WELCOME
+// and the worker accepted it in REG; without it chunks are sent as fast as
+// the connection allows.
+const StreamWindow = 16
+
+// ErrStreamStopped is returned by WriteStreamCredit when the stream is
+// abandoned, or its credit closed, while waiting for credit.
+var ErrStreamStopped = errors.New("stream stopped while waiting for flow control credit")
+
+// NewWindow returns a WINDOW frame granting the peer n more chunks of the
+// body of requestId.
+func NewWindow(requestId string, n int) *TcpMessage {
+	return &TcpMessage{
+		Sub:       "WINDOW",
+		RequestId: requestId,
+		Msg:       []byte(strconv.Itoa(n)),
+	}
+}
+
+// WindowSize returns the number of chunks granted by a WINDOW frame.
+func WindowSize(window *TcpMessage) (int, error) {
+	n, err := strconv.Atoi(string(window.Msg))
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid WINDOW size " + strconv.Quote(string(window.Msg)))
+	}
+	return n, nil
+}
+
+// Credit counts the chunks a sender may still send for one request body.
+// It starts at StreamWindow.
+type Credit struct {
+	mu      sync.Mutex
+	n       int
+	closed  bool
+	granted chan struct{} // signalled when credit is added or closed
+}
+
+func NewCredit() *Credit {
+	return &Credit{n: StreamWindow, granted: make(chan struct{}, 1)}
+}
+
+// Grant adds n chunks of credit.
+func (c *Credit) Grant(n int) {
+	c.mu.Lock()
+	c.n += n
+	c.mu.Unlock()
+	select {
+	case c.granted <- struct{}{}:
+	default:
+	}
+}
+
+// Close ends the stream, e.g. because the peer answered without reading
+// the rest of the body: Take fails from then on.
+func (c *Credit) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	select {
+	case c.granted <- struct{}{}:
+	default:
+	}
+}
+
+// Take uses one chunk of credit, waiting for a grant while there is none.
+// It reports false if done is closed or c is closed first.
+func (c *Credit) Take(done <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return false
+		}
+		if c.n > 0 {
+			c.n--
+			c.mu.Unlock()
+			return true
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.granted:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// Receipts counts the chunks a receiver has consumed. Consume returns the
+// number to grant back to the sender, every half window, or zero.
+type Receipts int
+
+func (r *Receipts) Consume() int {
+	*r++
+	if *r < StreamWindow/2 {
+		return 0
+	}
+	n := int(*r)
+	*r = 0
+	return n
+}
@@ -0,0 +1,33 @@
+package typedefs
+
+import (
+	"strconv"
+	"time"
+)
+
+// NewHeartbeat returns a HEARTBEAT frame stamped with the current time. The
+// peer echoes the payload back in a HEARTBEAT_RESPONSE.
+func NewHeartbeat() *TcpMessage {
+	return &TcpMessage{
+		Sub: "HEARTBEAT",
+		Msg: []byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+	}
+}
+
+// NewHeartbeatResponse answers a HEARTBEAT frame by echoing its payload.
+func NewHeartbeatResponse(heartbeat *TcpMessage) *TcpMessage {
+	return &TcpMessage{
+		Sub: "HEARTBEAT_RESPONSE",
+		Msg: heartbeat.Msg,
+	}
+}
+
+// HeartbeatRTT returns the round trip time of a HEARTBEAT_RESPONSE to a
+// heartbeat created by NewHeartbeat.
+func HeartbeatRTT(response *TcpMessage) (time.Duration, error) {
+	sent, err := strconv.ParseInt(string(response.Msg), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(time.Unix(0, sent)), nil
+}
@@ -0,0 +1,65 @@
+package typedefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// TLSInfo describes the TLS connection a request arrived on at the gateway.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+// TraceContext holds the W3C traceparent and tracestate of a request, see
+// the tracing package.
+type TraceContext struct {
+	TraceParent string `json:"traceparent"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// Param returns the value of the path parameter name, or "" if the route
+// has no such parameter.
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
+// URL returns the full URL the client requested.
+func (r *Request) URL() *url.URL {
+	return &url.URL{
+		Scheme:   r.Scheme,
+		Host:     r.Host,
+		Path:     r.Path,
+		RawQuery: r.RawQuery,
+	}
+}
+
+// Query parses the query string. Malformed pairs are skipped.
+func (r *Request) Query() url.Values {
+	values, _ := url.ParseQuery(r.RawQuery)
+	return values
+}
+
+// Cookies parses the cookies sent with the request.
+func (r *Request) Cookies() []*http.Cookie {
+	return (&http.Request{Header: http.Header(r.Headers)}).Cookies()
+}
+
+// Cookie returns the named cookie or http.ErrNoCookie.
+func (r *Request) Cookie(name string) (*http.Cookie, error) {
+	return (&http.Request{Header: http.Header(r.Headers)}).Cookie(name)
+}
+
+// DecodeJSON decodes the JSON request body into v. It reads BodyReader when
+// set, so it also works for streamed bodies, and can only be called once.
+func (r *Request) DecodeJSON(v interface{}) error {
+	var body io.Reader = bytes.NewReader(r.Body)
+	if r.BodyReader != nil {
+		body = r.BodyReader
+	}
+	return json.NewDecoder(body).Decode(v)
+}
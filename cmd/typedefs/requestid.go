@@ -0,0 +1,51 @@
+package typedefs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// RequestIDHeader carries the request ID between callers, the gateway and
+// workers, and is echoed in every response.
+const RequestIDHeader = "X-Request-Id"
+
+// MaxRequestIDLength bounds the request IDs accepted from callers.
+const MaxRequestIDLength = 128
+
+// crockford is the ULID alphabet: Crockford's base32, without I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewRequestID returns a ULID: 48 bits of millisecond timestamp followed by
+// 80 random bits, as 26 characters that sort by creation time. IDs never
+// repeat in practice, across gateway restarts included.
+func NewRequestID() string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	rand.Read(id[6:])
+
+	// 128 bits as 26 base32 digits, the first one carrying only 3 bits
+	var out [26]byte
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// ValidRequestID reports whether id can be used as a request ID: 1 to
+// MaxRequestIDLength visible ASCII characters, so it is safe to log and to
+// send back in a header.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
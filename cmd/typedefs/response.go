@@ -0,0 +1,75 @@
+package typedefs
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Response is the payload of RESPONSE and ERROR frames. It has the same JSON
+// shape as conversion.HttpResponse, but header values may be repeated.
+type Response struct {
+	StatusCode int32   `json:"status_code"`
+	Headers    Headers `json:"headers,omitempty"`
+	Body       []byte  `json:"body"`
+	// Stream is set when the body follows as RESPONSE_CHUNK frames
+	// terminated by END.
+	Stream bool `json:"stream,omitempty"`
+	// Duration is the time the worker spent on the request before sending
+	// the response head, reported for the gateway's metrics.
+	Duration time.Duration `json:"duration,omitempty"`
+	// BodyReader, when set by a callback, is streamed to the caller instead
+	// of Body. It is closed after streaming if it implements io.Closer.
+	BodyReader io.Reader `json:"-"`
+}
+
+// Headers holds multi-valued HTTP headers. When decoding it also accepts the
+// single-valued form produced by conversion.HttpResponse.
+type Headers map[string][]string
+
+// Get returns the first value of the header key, which is canonicalised
+// like http.Header.Get.
+func (h Headers) Get(key string) string {
+	return http.Header(h).Get(key)
+}
+
+func (h *Headers) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	headers := make(Headers, len(raw))
+	for key, value := range raw {
+		var values []string
+		if err := json.Unmarshal(value, &values); err != nil {
+			var single string
+			if err := json.Unmarshal(value, &single); err != nil {
+				return err
+			}
+			values = []string{single}
+		}
+		headers[key] = values
+	}
+	*h = headers
+	return nil
+}
+
+// NewJSONResponse marshals v into a Response with a JSON content type.
+func NewJSONResponse(statusCode int, v interface{}) (*Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		StatusCode: int32(statusCode),
+		Headers:    Headers{"Content-Type": {"application/json"}},
+		Body:       body,
+	}, nil
+}
+
+// NewErrorResponse builds the JSON error body sent with ERROR frames.
+func NewErrorResponse(statusCode int, err error) *Response {
+	resp, _ := NewJSONResponse(statusCode, map[string]string{"error": err.Error()})
+	return resp
+}
@@ -0,0 +1,217 @@
+package typedefs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Route is a pattern workers register paths with. Patterns are one of
+//
+//	/stocks            exact path
+//	/stocks/{symbol}   template, {name} matches one segment
+//	/static/*          prefix, * matches the rest of the path (possibly empty)
+//
+// optionally preceded by an HTTP method and a space, e.g. "GET /stocks".
+// Trailing slashes are not significant.
+type Route struct {
+	Pattern  string
+	Method   string // empty matches any method
+	segments []routeSegment
+	prefix   bool
+}
+
+type routeSegment struct {
+	literal string
+	param   string // set for {name} segments
+}
+
+// WildcardParam is the Params key holding the rest of the path matched by a
+// prefix route.
+const WildcardParam = "*"
+
+var ErrMethodNotAllowed = errors.New("method not allowed")
+
+// ParseRoute parses a route pattern.
+func ParseRoute(pattern string) (*Route, error) {
+	route := &Route{Pattern: pattern}
+	path := pattern
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		route.Method = strings.ToUpper(method)
+		path = strings.TrimSpace(rest)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("route %q: path must start with /", pattern)
+	}
+
+	seen := make(map[string]bool)
+	parts := splitPath(path)
+	for i, part := range parts {
+		switch {
+		case part == "*":
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("route %q: * must be the last segment", pattern)
+			}
+			route.prefix = true
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" || name == WildcardParam || strings.ContainsAny(name, "{}") {
+				return nil, fmt.Errorf("route %q: invalid parameter %q", pattern, part)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("route %q: duplicate parameter %q", pattern, name)
+			}
+			seen[name] = true
+			route.segments = append(route.segments, routeSegment{param: name})
+		case strings.ContainsAny(part, "{}*"):
+			return nil, fmt.Errorf("route %q: invalid segment %q", pattern, part)
+		default:
+			route.segments = append(route.segments, routeSegment{literal: part})
+		}
+	}
+	return route, nil
+}
+
+// Match reports whether the route matches path, ignoring the method, and
+// returns the path parameters.
+func (r *Route) Match(path string) (map[string]string, bool) {
+	parts := splitPath(path)
+	if len(parts) < len(r.segments) || (!r.prefix && len(parts) != len(r.segments)) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, segment := range r.segments {
+		if segment.param != "" {
+			params[segment.param] = parts[i]
+		} else if segment.literal != parts[i] {
+			return nil, false
+		}
+	}
+	if r.prefix {
+		params[WildcardParam] = strings.Join(parts[len(r.segments):], "/")
+	}
+	return params, true
+}
+
+// AllowsMethod reports whether the route accepts requests with method. A
+// GET route also accepts HEAD.
+func (r *Route) AllowsMethod(method string) bool {
+	return r.Method == "" || r.Method == method || (r.Method == http.MethodGet && method == http.MethodHead)
+}
+
+// Covers reports whether every request other can match is also matched by
+// r, e.g. "/api/*" covers "GET /api/{id}". The gateway's auth policy grants
+// path patterns this way.
+func (r *Route) Covers(other *Route) bool {
+	if r.Method != "" && r.Method != other.Method {
+		return false
+	}
+	if len(other.segments) < len(r.segments) {
+		return false
+	}
+	if !r.prefix && (other.prefix || len(other.segments) != len(r.segments)) {
+		return false
+	}
+	for i, segment := range r.segments {
+		if segment.param == "" && (other.segments[i].param != "" || other.segments[i].literal != segment.literal) {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific reports whether r should win over other when both match the
+// same request: literal segments beat parameters, parameters beat a prefix
+// wildcard, and a route with a method beats one without.
+func (r *Route) moreSpecific(other *Route) bool {
+	a, b := r.ranks(), other.ranks()
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return r.Method != "" && other.Method == ""
+}
+
+// ranks scores each segment of the route for moreSpecific.
+func (r *Route) ranks() []int {
+	const (
+		rankWildcard = iota
+		rankEnd
+		rankParam
+		rankLiteral
+	)
+	ranks := make([]int, 0, len(r.segments)+1)
+	for _, segment := range r.segments {
+		if segment.param != "" {
+			ranks = append(ranks, rankParam)
+		} else {
+			ranks = append(ranks, rankLiteral)
+		}
+	}
+	if r.prefix {
+		return append(ranks, rankWildcard)
+	}
+	return append(ranks, rankEnd)
+}
+
+// MatchRoute picks the most specific of routes for a request and returns
+// its path parameters. When routes match the path but none allows the
+// method it fails with ErrMethodNotAllowed.
+func MatchRoute(routes []*Route, method, path string) (*Route, map[string]string, error) {
+	var best *Route
+	var bestParams map[string]string
+	pathMatched := false
+	for _, route := range routes {
+		params, ok := route.Match(path)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if !route.AllowsMethod(method) {
+			continue
+		}
+		// Equally specific routes are ordered by pattern so every caller
+		// resolves a request the same way
+		if best == nil || route.moreSpecific(best) ||
+			(!best.moreSpecific(route) && route.Pattern < best.Pattern) {
+			best, bestParams = route, params
+		}
+	}
+	switch {
+	case best != nil:
+		return best, bestParams, nil
+	case pathMatched:
+		return nil, nil, ErrMethodNotAllowed
+	default:
+		return nil, nil, errors.New("no route matches " + path)
+	}
+}
+
+// AllowedMethods lists the methods accepted by the routes matching path,
+// for the Allow header of a 405 response.
+func AllowedMethods(routes []*Route, path string) []string {
+	seen := make(map[string]bool)
+	var methods []string
+	for _, route := range routes {
+		if _, ok := route.Match(path); ok && route.Method != "" && !seen[route.Method] {
+			seen[route.Method] = true
+			methods = append(methods, route.Method)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,251 @@
+package typedefs
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func mustParseRoutes(t *testing.T, patterns ...string) []*Route {
+	t.Helper()
+	routes := make([]*Route, 0, len(patterns))
+	for _, pattern := range patterns {
+		route, err := ParseRoute(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		wantMethod string
+		wantErr    bool
+	}{
+		{"/stocks", "", false},
+		{"/stocks/", "", false},
+		{"/", "", false},
+		{"/stocks/{symbol}", "", false},
+		{"/static/*", "", false},
+		{"get /stocks/{symbol}/history", "GET", false},
+		{"POST /items", "POST", false},
+		{"stocks", "", true},
+		{"GET stocks", "", true},
+		{"/static/*/more", "", true},
+		{"/stocks/{}", "", true},
+		{"/stocks/{*}", "", true},
+		{"/stocks/{a{b}", "", true},
+		{"/stocks/{id}/{id}", "", true},
+		{"/stocks/sym{bol}", "", true},
+		{"/stocks/a*", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			route, err := ParseRoute(tt.pattern)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", route)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.Pattern != tt.pattern || route.Method != tt.wantMethod {
+				t.Errorf("got pattern %q method %q, want %q %q", route.Pattern, route.Method, tt.pattern, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    map[string]string // nil if the route must not match
+	}{
+		{"/stocks", "/stocks", map[string]string{}},
+		{"/stocks", "/stocks/", map[string]string{}},
+		{"/stocks/", "/stocks", map[string]string{}},
+		{"/stocks", "/stocks/AAPL", nil},
+		{"/stocks", "/bonds", nil},
+		{"/", "/", map[string]string{}},
+		{"/", "/stocks", nil},
+		{"/stocks/{symbol}", "/stocks/AAPL", map[string]string{"symbol": "AAPL"}},
+		{"/stocks/{symbol}", "/stocks", nil},
+		{"/stocks/{symbol}", "/stocks/AAPL/history", nil},
+		{"/stocks/{symbol}/history/{year}", "/stocks/AAPL/history/2024", map[string]string{"symbol": "AAPL", "year": "2024"}},
+		{"/static/*", "/static/css/site.css", map[string]string{"*": "css/site.css"}},
+		{"/static/*", "/static", map[string]string{"*": ""}},
+		{"/static/*", "/statics/site.css", nil},
+		{"/*", "/anything/at/all", map[string]string{"*": "anything/at/all"}},
+		{"GET /stocks", "/stocks", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			route := mustParseRoutes(t, tt.pattern)[0]
+			params, ok := route.Match(tt.path)
+			if ok != (tt.want != nil) {
+				t.Fatalf("got match %v, want %v", ok, tt.want != nil)
+			}
+			if ok && !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("got params %v, want %v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteAllowsMethod(t *testing.T) {
+	tests := []struct {
+		pattern string
+		method  string
+		want    bool
+	}{
+		{"/stocks", "DELETE", true},
+		{"GET /stocks", "GET", true},
+		{"GET /stocks", "HEAD", true},
+		{"GET /stocks", "POST", false},
+		{"HEAD /stocks", "GET", false},
+		{"POST /stocks", "POST", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.method, func(t *testing.T) {
+			if got := mustParseRoutes(t, tt.pattern)[0].AllowsMethod(tt.method); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteCovers(t *testing.T) {
+	tests := []struct {
+		granted string
+		claimed string
+		want    bool
+	}{
+		{"/stocks", "/stocks", true},
+		{"/stocks", "/stocks/", true},
+		{"/stocks", "/bonds", false},
+		{"/stocks", "/stocks/{symbol}", false},
+		{"/stocks/{symbol}", "/stocks/AAPL", true},
+		{"/stocks/{symbol}", "/stocks/{id}", true},
+		{"/stocks/AAPL", "/stocks/{symbol}", false},
+		{"/stocks/*", "/stocks", true},
+		{"/stocks/*", "/stocks/{symbol}/history", true},
+		{"/stocks/*", "/stocks/*", true},
+		{"/stocks/*", "/bonds/*", false},
+		{"/stocks/{symbol}", "/stocks/*", false},
+		{"/*", "/anything/*", true},
+		{"/api/*", "GET /api/{id}", true},
+		{"GET /api/*", "GET /api/{id}", true},
+		{"GET /api/*", "POST /api/{id}", false},
+		{"GET /api/*", "/api/{id}", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granted+" covers "+tt.claimed, func(t *testing.T) {
+			routes := mustParseRoutes(t, tt.granted, tt.claimed)
+			if got := routes[0].Covers(routes[1]); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	routes := mustParseRoutes(t,
+		"/*",
+		"/stocks/*",
+		"/stocks/{symbol}",
+		"/stocks/AAPL",
+		"GET /items/{id}",
+		"DELETE /items/{id}",
+		"/items/{id}",
+		"POST /orders",
+		"PUT /orders",
+		"/a/{x}",
+		"/{y}/b",
+	)
+	tests := []struct {
+		method     string
+		path       string
+		want       string
+		wantParams map[string]string
+		wantErr    error
+	}{
+		{"GET", "/stocks/AAPL", "/stocks/AAPL", map[string]string{}, nil},
+		{"GET", "/stocks/MSFT", "/stocks/{symbol}", map[string]string{"symbol": "MSFT"}, nil},
+		{"GET", "/stocks/MSFT/history", "/stocks/*", map[string]string{"*": "MSFT/history"}, nil},
+		{"GET", "/stocks", "/stocks/*", map[string]string{"*": ""}, nil},
+		{"GET", "/bonds", "/*", map[string]string{"*": "bonds"}, nil},
+		{"GET", "/items/7", "GET /items/{id}", map[string]string{"id": "7"}, nil},
+		{"HEAD", "/items/7", "GET /items/{id}", map[string]string{"id": "7"}, nil},
+		{"DELETE", "/items/7", "DELETE /items/{id}", map[string]string{"id": "7"}, nil},
+		{"PATCH", "/items/7", "/items/{id}", map[string]string{"id": "7"}, nil},
+		{"PUT", "/orders", "PUT /orders", map[string]string{}, nil},
+		// A literal earlier in the path wins over one later in the path
+		{"GET", "/a/b", "/a/{x}", map[string]string{"x": "b"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			route, params, err := MatchRoute(routes, tt.method, tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if route.Pattern != tt.want {
+				t.Errorf("got route %q, want %q", route.Pattern, tt.want)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("got params %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestMatchRouteMethodNotAllowed(t *testing.T) {
+	routes := mustParseRoutes(t, "POST /orders", "PUT /orders", "GET /orders/{id}", "/stocks")
+	tests := []struct {
+		method      string
+		path        string
+		wantErr     error
+		wantAllowed []string
+	}{
+		{"GET", "/orders", ErrMethodNotAllowed, []string{"POST", "PUT"}},
+		{"POST", "/orders/7", ErrMethodNotAllowed, []string{"GET"}},
+		{"GET", "/bonds", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			route, _, err := MatchRoute(routes, tt.method, tt.path)
+			if err == nil {
+				t.Fatalf("got route %q, want an error", route.Pattern)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && errors.Is(err, ErrMethodNotAllowed) {
+				t.Errorf("got %v for an unrouted path", err)
+			}
+			if got := AllowedMethods(routes, tt.path); !reflect.DeepEqual(got, tt.wantAllowed) {
+				t.Errorf("got allowed methods %v, want %v", got, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestMatchRouteDeterministic(t *testing.T) {
+	// Equally specific routes resolve by pattern, whatever their order
+	routes := mustParseRoutes(t, "/items/{b}", "/items/{a}")
+	for i := 0; i < 2; i++ {
+		route, _, err := MatchRoute(routes, "GET", "/items/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.Pattern != "/items/{a}" {
+			t.Errorf("got %q, want /items/{a}", route.Pattern)
+		}
+		routes[0], routes[1] = routes[1], routes[0]
+	}
+}
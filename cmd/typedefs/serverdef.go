@@ -1,9 +1,12 @@
 package typedefs
 
 import (
-	"bytes"
-	"encoding/json"
-	"net"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 )
 
 type ServerBlock struct {
@@ -12,99 +15,272 @@ type ServerBlock struct {
 	TCP  int
 }
 type TcpMessage struct {
-	Sub       string `json:"sub"`
-	Msg       []byte `json:"msg"`
-	RequestId int32  `json:"request"`
+	Sub string `json:"sub"`
+	Msg []byte `json:"msg"`
+	// RequestId is the ID of the request the frame belongs to, see
+	// NewRequestID; empty on frames about the connection itself.
+	RequestId string `json:"request,omitempty"`
+
+	codec Codec // codec the message was read with
 }
 
 type Request struct {
-	RequestId int32             `json:"request_id"`
-	Method    string            `json:"method"`
-	Path      string            `json:"path"`
-	Headers   map[string]string `json:"headers"`
-	Body      []byte            `json:"body"`
+	// RequestId is the caller's X-Request-Id when it sent a valid one, or
+	// an ID generated by the gateway. The X-Request-Id header carries the
+	// same value.
+	RequestId string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	RawQuery  string `json:"query,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Scheme    string `json:"scheme,omitempty"`
+	Proto     string `json:"proto,omitempty"`
+	// RemoteAddr is the IP of the original client, taken from
+	// X-Forwarded-For or Forwarded when the gateway sits behind a trusted
+	// proxy.
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	TLS        *TLSInfo `json:"tls,omitempty"`
+	// Trace is the W3C trace context the request is part of. The gateway
+	// sets it to its forwarding span, or passes on the caller's when not
+	// tracing; the Traceparent header carries the same value.
+	Trace *TraceContext `json:"trace,omitempty"`
+	// Headers holds the end-to-end request headers with canonical keys;
+	// hop-by-hop headers are removed by the gateway.
+	Headers Headers `json:"headers"`
+	Body    []byte  `json:"body"`
+	// Stream is set when the body follows as REQUEST_CHUNK frames terminated
+	// by END instead of being carried in Body.
+	Stream bool `json:"stream,omitempty"`
+	// BodyReader streams the body of a streamed request on the worker side.
+	BodyReader io.Reader `json:"-"`
+	// Route is the pattern the gateway matched, and Params the values of
+	// its {name} segments and of the * wildcard.
+	Route  string            `json:"route,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
 }
+
+// ChunkSize is the largest body chunk carried by a single REQUEST_CHUNK or
+// RESPONSE_CHUNK frame.
+const ChunkSize = 32 * 1024
+
 type TcpInput struct {
 	Sub       string            `json:"sub"`
-	RequestID int32             `json:"request"`
+	RequestID string            `json:"request"`
 	Body      []byte            `json:"body"`
 	Headers   map[string]string `json:"headers"`
 }
 
-// TcpMessageReader reads TCP messages with framing support
+// Frames on the TCP channel start with an 8 byte header: the two magic
+// bytes "MC", the protocol version, the ID of the codec the payload is
+// encoded with and the payload length as a big-endian uint32.
+const (
+	FrameMagic0     byte = 'M'
+	FrameMagic1     byte = 'C'
+	FrameVersion    byte = 1
+	FrameHeaderSize      = 8
+
+	// DefaultMaxFrameSize is the largest payload a reader accepts unless
+	// configured otherwise.
+	DefaultMaxFrameSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrBadMagic           = errors.New("frame: bad magic, peer is not speaking the framed protocol")
+	ErrUnsupportedVersion = errors.New("frame: unsupported protocol version")
+	ErrFrameTooLarge      = errors.New("frame: payload exceeds maximum frame size")
+)
+
+// TcpMessageReader reads TCP messages with framing support. A reader
+// buffers the connection, so use a single reader per connection for its
+// whole lifetime.
 type TcpMessageReader struct {
-	conn net.Conn
+	r            *bufio.Reader
+	header       [FrameHeaderSize]byte
+	maxFrameSize int
 }
 
 // NewTcpMessageReader creates a new TcpMessageReader
-func NewTcpMessageReader(conn net.Conn) *TcpMessageReader {
-	return &TcpMessageReader{conn: conn}
+func NewTcpMessageReader(conn io.Reader) *TcpMessageReader {
+	return &TcpMessageReader{
+		r:            bufio.NewReader(conn),
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetMaxFrameSize limits the payload size the reader accepts. Larger frames
+// fail with ErrFrameTooLarge before their payload is allocated.
+func (r *TcpMessageReader) SetMaxFrameSize(n int) {
+	if n <= 0 {
+		n = DefaultMaxFrameSize
+	}
+	r.maxFrameSize = n
 }
 
 // ReadMessage reads a TCP message with framing support
 func (r *TcpMessageReader) ReadMessage() (*TcpMessage, error) {
-	// Read the length of the message
-	lengthBytes := make([]byte, 4)
-	_, err := r.conn.Read(lengthBytes)
+	payload, err := r.ReadFrame()
 	if err != nil {
 		return nil, err
 	}
-	length := int32(lengthBytes[0])<<24 | int32(lengthBytes[1])<<16 | int32(lengthBytes[2])<<8 | int32(lengthBytes[3])
 
-	// Read the message itself
-	messageBytes := make([]byte, length)
-	_, err = r.conn.Read(messageBytes)
-	if err != nil {
-		return nil, err
+	codec, ok := codecByID(r.header[3])
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, r.header[3])
 	}
+	message := TcpMessage{codec: codec}
+	if err := codec.Unmarshal(payload, &message); err != nil {
+		return nil, fmt.Errorf("frame: decoding %s message: %w", codec.Name(), err)
+	}
+	return &message, nil
+}
 
-	// Trim the null bytes from the message
-	messageBytes = bytes.Trim(messageBytes, "\x00")
-
-	// Unmarshal the message
-	var message TcpMessage
-	err = json.Unmarshal(messageBytes, &message)
-	if err != nil {
+// ReadFrame reads the header and the exact payload of the next frame.
+// Errors other than io.EOF leave the stream in an undefined position and the
+// connection should be closed.
+func (r *TcpMessageReader) ReadFrame() ([]byte, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("frame: truncated header: %w", err)
+		}
 		return nil, err
 	}
+	if r.header[0] != FrameMagic0 || r.header[1] != FrameMagic1 {
+		return nil, ErrBadMagic
+	}
+	if r.header[2] != FrameVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, r.header[2])
+	}
+	length := binary.BigEndian.Uint32(r.header[4:])
+	if uint64(length) > uint64(r.maxFrameSize) {
+		return nil, fmt.Errorf("%w: %d > %d bytes", ErrFrameTooLarge, length, r.maxFrameSize)
+	}
 
-	return &message, nil
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("frame: truncated payload: %w", err)
+	}
+	return payload, nil
 }
 
 // TcpMessageWriter writes TCP messages with framing support
 type TcpMessageWriter struct {
-	conn net.Conn
+	conn  io.Writer
+	codec Codec
+}
+
+// NewTcpMessageWriter creates a new TcpMessageWriter that encodes messages
+// with JSONCodec. Each frame is passed to conn in a single Write call.
+func NewTcpMessageWriter(conn io.Writer) *TcpMessageWriter {
+	return &TcpMessageWriter{conn: conn, codec: JSONCodec}
 }
 
-// NewTcpMessageWriter creates a new TcpMessageWriter
-func NewTcpMessageWriter(conn net.Conn) *TcpMessageWriter {
-	return &TcpMessageWriter{conn: conn}
+// SetCodec changes the codec used for subsequent messages. It must not be
+// called while other goroutines write with w.
+func (w *TcpMessageWriter) SetCodec(codec Codec) {
+	w.codec = codec
+}
+
+// Codec returns the codec messages are encoded with.
+func (w *TcpMessageWriter) Codec() Codec {
+	return w.codec
 }
 
 func (w *TcpMessageWriter) WriteMessage(message *TcpMessage) error {
-	// Marshal the message
-	messageBytes, err := json.Marshal(message)
+	messageBytes, err := w.codec.Marshal(message)
 	if err != nil {
 		return err
 	}
+	return w.WriteFrame(messageBytes)
+}
 
-	// Create a buffer to hold the length prefix and the message
-	buf := make([]byte, 4+len(messageBytes))
-
-	// Write the length prefix
-	buf[0] = byte(len(messageBytes) >> 24)
-	buf[1] = byte(len(messageBytes) >> 16)
-	buf[2] = byte(len(messageBytes) >> 8)
-	buf[3] = byte(len(messageBytes))
-
-	// Write the message itself
-	copy(buf[4:], messageBytes)
+// WriteRequest sends request as a REQUEST frame.
+func (w *TcpMessageWriter) WriteRequest(request *Request) error {
+	payload, err := w.codec.MarshalRequest(request)
+	if err != nil {
+		return err
+	}
+	return w.WriteMessage(&TcpMessage{
+		Sub:       "REQUEST",
+		RequestId: request.RequestId,
+		Msg:       payload,
+	})
+}
 
-	// Write the buffer to the connection
-	_, err = w.conn.Write(buf)
+// WriteResponse sends response as a frame of type sub, RESPONSE or ERROR.
+func (w *TcpMessageWriter) WriteResponse(sub string, requestId string, response *Response) error {
+	payload, err := w.codec.MarshalResponse(response)
 	if err != nil {
 		return err
 	}
+	return w.WriteMessage(&TcpMessage{
+		Sub:       sub,
+		RequestId: requestId,
+		Msg:       payload,
+	})
+}
+
+// WriteFrame writes payload behind a frame header. Header and payload go
+// out in a single Write so frames from concurrent writers never interleave.
+func (w *TcpMessageWriter) WriteFrame(payload []byte) error {
+	if uint64(len(payload)) > math.MaxUint32 {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, FrameHeaderSize+len(payload))
+	buf[0] = FrameMagic0
+	buf[1] = FrameMagic1
+	buf[2] = FrameVersion
+	buf[3] = w.codec.ID()
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(payload)))
+	copy(buf[FrameHeaderSize:], payload)
+
+	_, err := w.conn.Write(buf)
+	return err
+}
+
+// WriteStream copies r to the connection as frames of type sub carrying at
+// most ChunkSize bytes each, followed by an END frame. The END frame is sent
+// even when reading r fails so the peer does not wait forever; the read
+// error is returned.
+func (w *TcpMessageWriter) WriteStream(requestId string, sub string, r io.Reader) error {
+	return w.WriteStreamCredit(requestId, sub, r, nil, nil)
+}
 
-	return nil
+// WriteStreamCredit is like WriteStream, but takes one chunk of credit
+// before each frame, waiting for the peer's WINDOW grants. It returns
+// ErrStreamStopped, without sending END, if done is closed meanwhile. A nil
+// credit sends without flow control.
+func (w *TcpMessageWriter) WriteStreamCredit(requestId string, sub string, r io.Reader, credit *Credit, done <-chan struct{}) error {
+	buf := make([]byte, ChunkSize)
+	var readErr error
+	for readErr == nil {
+		var n int
+		n, readErr = r.Read(buf)
+		if n > 0 {
+			if credit != nil && !credit.Take(done) {
+				return ErrStreamStopped
+			}
+			chunk := TcpMessage{
+				Sub:       sub,
+				RequestId: requestId,
+				Msg:       buf[:n],
+			}
+			if err := w.WriteMessage(&chunk); err != nil {
+				return err
+			}
+		}
+	}
+	end := TcpMessage{
+		Sub:       "END",
+		RequestId: requestId,
+	}
+	if err := w.WriteMessage(&end); err != nil {
+		return err
+	}
+	if readErr == io.EOF {
+		return nil
+	}
+	return readErr
 }
@@ -0,0 +1,112 @@
+package typedefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// frame builds a raw frame with the given header fields.
+func frame(magic0, magic1, version byte, length uint32, payload string) []byte {
+	b := []byte{magic0, magic1, version, JSONCodec.ID(), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[4:], length)
+	return append(b, payload...)
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		wantErr error
+	}{
+		{"valid", frame('M', 'C', FrameVersion, 2, "{}"), "{}", nil},
+		{"empty payload", frame('M', 'C', FrameVersion, 0, ""), "", nil},
+		{"closed connection", nil, "", io.EOF},
+		{"bad magic", frame('H', 'T', FrameVersion, 2, "{}"), "", ErrBadMagic},
+		{"unsupported version", frame('M', 'C', FrameVersion+1, 2, "{}"), "", ErrUnsupportedVersion},
+		{"oversize length", frame('M', 'C', FrameVersion, 17, strings.Repeat("x", 17)), "", ErrFrameTooLarge},
+		{"truncated header", []byte{'M', 'C', FrameVersion}, "", io.ErrUnexpectedEOF},
+		{"truncated payload", frame('M', 'C', FrameVersion, 10, "{}"), "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewTcpMessageReader(bytes.NewReader(tt.input))
+			reader.SetMaxFrameSize(16)
+			payload, err := reader.ReadFrame()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(payload) != tt.want {
+				t.Errorf("got payload %q, want %q", payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFrameSequence(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewTcpMessageWriter(&buf)
+	for _, sub := range []string{"HEARTBEAT", "REQUEST", "END"} {
+		if err := writer.WriteMessage(&TcpMessage{Sub: sub}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := NewTcpMessageReader(&buf)
+	for _, want := range []string{"HEARTBEAT", "REQUEST", "END"} {
+		message, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Sub != want {
+			t.Errorf("got %q, want %q", message.Sub, want)
+		}
+	}
+	if _, err := reader.ReadMessage(); err != io.EOF {
+		t.Errorf("got %v after the last frame, want io.EOF", err)
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, ProtobufCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			body := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
+			var buf bytes.Buffer
+			writer := NewTcpMessageWriter(&buf)
+			writer.SetCodec(codec)
+			if err := writer.WriteStream("01HZX4T3QK8V6N0J2M5R7W9Y1B", "RESPONSE_CHUNK", bytes.NewReader(body)); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := NewTcpMessageReader(&buf)
+			var got []byte
+			chunks := 0
+			for {
+				message, err := reader.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.RequestId != "01HZX4T3QK8V6N0J2M5R7W9Y1B" {
+					t.Fatalf("got request ID %q", message.RequestId)
+				}
+				if message.Sub == "END" {
+					break
+				}
+				if message.Sub != "RESPONSE_CHUNK" || len(message.Msg) > ChunkSize {
+					t.Fatalf("got %s frame of %d bytes", message.Sub, len(message.Msg))
+				}
+				got = append(got, message.Msg...)
+				chunks++
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("got %d bytes, want %d", len(got), len(body))
+			}
+			if want := (len(body) + ChunkSize - 1) / ChunkSize; chunks != want {
+				t.Errorf("got %d chunks, want %d", chunks, want)
+			}
+		})
+	}
+}
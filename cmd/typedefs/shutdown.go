@@ -0,0 +1,37 @@
+package typedefs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Shutdown is the payload of the SHUTDOWN frame a gateway sends to every
+// worker when it stops. No new requests follow it; requests already sent
+// are still answered until Deadline, after which the gateway closes the
+// connection.
+type Shutdown struct {
+	Deadline time.Time `json:"deadline"`
+}
+
+// NewShutdown returns a SHUTDOWN frame announcing that the gateway closes
+// the connection at deadline at the latest.
+func NewShutdown(deadline time.Time) *TcpMessage {
+	payload, _ := json.Marshal(Shutdown{Deadline: deadline})
+	return &TcpMessage{
+		Sub: "SHUTDOWN",
+		Msg: payload,
+	}
+}
+
+// NewDrain returns the DRAIN frame a worker sends before it stops. The
+// gateway routes no more requests to it and answers with DRAINED once the
+// requests already routed to it have finished.
+func NewDrain() *TcpMessage {
+	return &TcpMessage{Sub: "DRAIN"}
+}
+
+// NewDrained returns the DRAINED frame answering a DRAIN. No requests
+// follow it on the connection.
+func NewDrained() *TcpMessage {
+	return &TcpMessage{Sub: "DRAINED"}
+}
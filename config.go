@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the gateway configuration loaded by main.
+var config = DefaultConfig()
+
+// Config is the gateway configuration. It is read from a YAML or JSON file
+// given with -config, such as
+//
+//	http_addr: ":8080"
+//	tcp_addr: "127.0.0.1:8081"
+//	request_timeout: 5m
+//	cors:
+//	  allow_origins: ["https://app.example.com"]
+//	routes:
+//	  "POST /upload/*":
+//	    timeout: 30m
+//	    max_body_size: 1073741824
+//	  "/ollama/*":
+//	    timeout: 1h
+//
+// Every setting can be overridden by a GATEWAY_* environment variable and by
+// a command-line flag; see LoadConfig.
+type Config struct {
+	HTTPAddr string `yaml:"http_addr"` // public HTTP listener
+	TCPAddr  string `yaml:"tcp_addr"`  // worker TCP listener
+	GRPCAddr string `yaml:"grpc_addr"` // registration gRPC listener
+
+	RequestTimeout  time.Duration `yaml:"request_timeout"`  // wait for a worker's response, or between streamed chunks
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // wait for in-flight requests on SIGTERM
+	MaxBodySize     int64         `yaml:"max_body_size"`    // largest request body in bytes, zero for no limit
+	ViewerFile      string        `yaml:"viewer_file"`      // page served at /viewer, empty to disable it
+	MetricsPath     string        `yaml:"metrics_path"`     // Prometheus metrics endpoint, empty to disable it
+	CORS            CORSConfig    `yaml:"cors"`
+
+	LoadBalancing  LoadBalancingConfig `yaml:"load_balancing"`
+	Heartbeat      HeartbeatConfig     `yaml:"heartbeat"`
+	Workers        WorkersConfig       `yaml:"workers"`
+	TrustedProxies []string            `yaml:"trusted_proxies"` // IPs or CIDRs whose forwarding headers are trusted
+	AuthPolicy     string              `yaml:"auth_policy"`     // JSON auth policy file, empty for no authentication
+	TLS            TLSConfig           `yaml:"tls"`
+	Tracing        TracingConfig       `yaml:"tracing"`
+	Log            LogConfig           `yaml:"log"`
+
+	// Routes overrides settings for requests matched to a registered route
+	// pattern, such as "/ollama/*" or "POST /upload/*". The key must equal
+	// the pattern the workers register.
+	Routes map[string]RouteConfig `yaml:"routes"`
+}
+
+// CORSConfig is the CORS policy of the gateway or of a route. Without
+// origins, no CORS headers are sent.
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allow_origins"` // "*" allows any origin
+	AllowMethods []string `yaml:"allow_methods"`
+	AllowHeaders []string `yaml:"allow_headers"`
+}
+
+type LoadBalancingConfig struct {
+	Strategy   string `yaml:"strategy"`    // see ParseStrategy
+	HashHeader string `yaml:"hash_header"` // request header hashed by header_hash
+}
+
+type HeartbeatConfig struct {
+	Interval time.Duration `yaml:"interval"` // zero disables heartbeats
+	Misses   int           `yaml:"misses"`   // silent intervals before a worker is disconnected
+}
+
+type WorkersConfig struct {
+	WriteQueueSize int           `yaml:"write_queue_size"` // frames queued per connection before requests get 503
+	WriteTimeout   time.Duration `yaml:"write_timeout"`    // deadline for writing one frame, zero for none
+	MaxFrameSize   int           `yaml:"max_frame_size"`   // largest frame payload accepted from workers
+}
+
+type TLSConfig struct {
+	CertFile          string        `yaml:"cert_file"`      // enables TLS on the TCP and gRPC listeners
+	KeyFile           string        `yaml:"key_file"`       // private key of CertFile
+	ClientCAFile      string        `yaml:"client_ca_file"` // CAs verifying worker certificates
+	RequireClientCert bool          `yaml:"require_client_cert"`
+	ReloadInterval    time.Duration `yaml:"reload_interval"` // how often the files are checked for changes
+}
+
+type TracingConfig struct {
+	Export      string  `yaml:"export"`       // OTLP/HTTP URL or file for spans, empty to disable tracing
+	ServiceName string  `yaml:"service_name"` // service.name of exported spans
+	SampleRatio float64 `yaml:"sample_ratio"` // share of new traces recorded; callers' decisions are kept
+}
+
+type LogConfig struct {
+	Format     string `yaml:"format"`      // text or json
+	Level      string `yaml:"level"`       // debug, info, warn or error
+	AdminPath  string `yaml:"admin_path"`  // endpoint reading and changing the level, empty to disable it
+	AdminToken string `yaml:"admin_token"` // bearer token AdminPath requires, which is not served without one
+}
+
+// RouteConfig overrides gateway settings for one route. Zero values inherit
+// the gateway's.
+type RouteConfig struct {
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxBodySize int64         `yaml:"max_body_size"` // -1 lifts the gateway's limit
+	CORS        *CORSConfig   `yaml:"cors"`
+}
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		HTTPAddr:        ":8080",
+		TCPAddr:         "127.0.0.1:8081",
+		GRPCAddr:        ":50051",
+		RequestTimeout:  300 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		ViewerFile:      "web/static/screenshot.html",
+		MetricsPath:     "/metrics",
+		CORS: CORSConfig{
+			AllowOrigins: []string{"*"},
+			AllowMethods: []string{"GET", "POST", "OPTIONS"},
+			AllowHeaders: []string{"Content-Type"},
+		},
+		LoadBalancing: LoadBalancingConfig{
+			Strategy:   string(RoundRobin),
+			HashHeader: "X-Session-Id",
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval: 15 * time.Second,
+			Misses:   3,
+		},
+		Workers: WorkersConfig{
+			WriteQueueSize: 256,
+			WriteTimeout:   10 * time.Second,
+			MaxFrameSize:   typedefs.DefaultMaxFrameSize,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: 30 * time.Second,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "multichannel-gateway",
+			SampleRatio: 1,
+		},
+		Log: LogConfig{
+			Format:    "text",
+			Level:     "info",
+			AdminPath: "/admin/log-level",
+		},
+	}
+}
+
+// bindFlags defines a flag for every setting but Routes on fs, writing into c.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "address of the public HTTP listener")
+	fs.StringVar(&c.TCPAddr, "tcp-addr", c.TCPAddr, "address workers connect to over TCP")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", c.GRPCAddr, "address of the gRPC registration service")
+	fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "how long to wait for a worker's response, or between chunks of a streamed one")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on SIGTERM before closing them")
+	fs.Int64Var(&c.MaxBodySize, "max-body-size", c.MaxBodySize, "largest request body in bytes (0 for no limit)")
+	fs.StringVar(&c.ViewerFile, "viewer-file", c.ViewerFile, "HTML page served at /viewer (empty disables it)")
+	fs.StringVar(&c.MetricsPath, "metrics-path", c.MetricsPath, "path of the Prometheus metrics endpoint (empty disables it)")
+	fs.Var((*stringList)(&c.CORS.AllowOrigins), "cors-allow-origins", "comma-separated origins allowed by CORS, or * (empty disables CORS)")
+	fs.Var((*stringList)(&c.CORS.AllowMethods), "cors-allow-methods", "comma-separated methods allowed by CORS")
+	fs.Var((*stringList)(&c.CORS.AllowHeaders), "cors-allow-headers", "comma-separated request headers allowed by CORS")
+	fs.StringVar(&c.LoadBalancing.Strategy, "lb-strategy", c.LoadBalancing.Strategy, "load balancing strategy: round_robin, least_in_flight, random or header_hash")
+	fs.StringVar(&c.LoadBalancing.HashHeader, "lb-hash-header", c.LoadBalancing.HashHeader, "request header hashed by the header_hash strategy")
+	fs.DurationVar(&c.Heartbeat.Interval, "heartbeat-interval", c.Heartbeat.Interval, "interval between heartbeats to workers (0 disables)")
+	fs.IntVar(&c.Heartbeat.Misses, "heartbeat-misses", c.Heartbeat.Misses, "missed heartbeat intervals before a worker is disconnected")
+	fs.IntVar(&c.Workers.WriteQueueSize, "write-queue-size", c.Workers.WriteQueueSize, "frames queued per worker connection before requests are rejected with 503")
+	fs.DurationVar(&c.Workers.WriteTimeout, "write-timeout", c.Workers.WriteTimeout, "deadline for writing a frame to a worker before it is disconnected (0 disables)")
+	fs.IntVar(&c.Workers.MaxFrameSize, "max-frame-size", c.Workers.MaxFrameSize, "largest TCP frame payload in bytes accepted from workers")
+	fs.Var((*stringList)(&c.TrustedProxies), "trusted-proxies", "comma-separated IPs or CIDRs of proxies whose X-Forwarded-* and Forwarded headers are trusted")
+	fs.StringVar(&c.AuthPolicy, "auth-policy", c.AuthPolicy, "JSON file with the credentials workers authenticate with and the paths each may claim (default: no authentication)")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "PEM certificate for the TCP and gRPC listeners (enables TLS)")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "PEM private key of -tls-cert")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile, "PEM CAs verifying worker client certificates")
+	fs.BoolVar(&c.TLS.RequireClientCert, "tls-require-client-cert", c.TLS.RequireClientCert, "reject workers without a certificate signed by -tls-client-ca")
+	fs.DurationVar(&c.TLS.ReloadInterval, "tls-reload-interval", c.TLS.ReloadInterval, "how often certificate files are checked for changes")
+	fs.StringVar(&c.Tracing.Export, "trace-export", c.Tracing.Export, "OTLP/HTTP traces URL (e.g. http://localhost:4318/v1/traces) or file to write spans to as OTLP JSON (empty disables tracing)")
+	fs.StringVar(&c.Tracing.ServiceName, "trace-service-name", c.Tracing.ServiceName, "service name of exported spans")
+	fs.Float64Var(&c.Tracing.SampleRatio, "trace-sample-ratio", c.Tracing.SampleRatio, "share of new traces to record, between 0 and 1")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log output format: text or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "minimum log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.AdminPath, "log-admin-path", c.Log.AdminPath, "path of the endpoint reading and changing the log level (empty disables it)")
+	fs.StringVar(&c.Log.AdminToken, "log-admin-token", c.Log.AdminToken, "bearer token required by -log-admin-path, which is not served without one")
+}
+
+// stringList is a comma-separated flag. Setting it replaces the list, so a
+// flag overrides the file rather than adding to it.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable overriding a flag: -tcp-addr is
+// GATEWAY_TCP_ADDR.
+func envName(flagName string) string {
+	return "GATEWAY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// LoadConfig parses args with fs and builds the configuration. Settings are
+// taken, from lowest to highest precedence, from DefaultConfig, the file
+// given with -config or GATEWAY_CONFIG, GATEWAY_* environment variables and
+// the command line. The result is validated; all problems are reported in
+// the returned error.
+func LoadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	c := DefaultConfig()
+	file := fs.String("config", "", "YAML or JSON configuration file (env "+envName("config")+")")
+	c.bindFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set with the environment variable named after it, e.g. %s.\n", envName("tcp-addr"))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Remember the command line, then rebuild the settings in order of
+	// precedence. The flags still point into c.
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	*c = *DefaultConfig()
+	if *file == "" {
+		*file = getenv(envName("config"))
+	}
+	if *file != "" {
+		if err := c.readFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if value, ok := explicit[f.Name]; ok {
+			f.Value.Set(value)
+		} else if value := getenv(envName(f.Name)); value != "" {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile merges a YAML or JSON file into c. Unknown keys are errors, so a
+// misspelt setting is not silently ignored.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the settings and returns every problem found, naming
+// them by their file keys.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	for _, addr := range []struct{ key, value string }{
+		{"http_addr", c.HTTPAddr},
+		{"tcp_addr", c.TCPAddr},
+		{"grpc_addr", c.GRPCAddr},
+	} {
+		if _, _, err := net.SplitHostPort(addr.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a host:port address", addr.key, addr.value))
+		}
+	}
+	check(c.MetricsPath == "" || (strings.HasPrefix(c.MetricsPath, "/") && c.MetricsPath != "/"), "metrics_path: %q must be a path other than /", c.MetricsPath)
+	check(c.RequestTimeout > 0, "request_timeout: must be positive, got %v", c.RequestTimeout)
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: must not be negative, got %v", c.ShutdownTimeout)
+	check(c.MaxBodySize >= 0, "max_body_size: must not be negative, got %d", c.MaxBodySize)
+	errs = append(errs, c.CORS.validate("cors"))
+
+	if _, err := ParseStrategy(c.LoadBalancing.Strategy); err != nil {
+		errs = append(errs, fmt.Errorf("load_balancing.strategy: %w", err))
+	}
+	check(c.Heartbeat.Interval >= 0, "heartbeat.interval: must not be negative, got %v", c.Heartbeat.Interval)
+	check(c.Heartbeat.Misses >= 1, "heartbeat.misses: must be at least 1, got %d", c.Heartbeat.Misses)
+	check(c.Workers.WriteQueueSize >= 1, "workers.write_queue_size: must be at least 1, got %d", c.Workers.WriteQueueSize)
+	check(c.Workers.WriteTimeout >= 0, "workers.write_timeout: must not be negative, got %v", c.Workers.WriteTimeout)
+	check(c.Workers.MaxFrameSize >= 1 && c.Workers.MaxFrameSize <= math.MaxUint32,
+		"workers.max_frame_size: must be between 1 and %d, got %d", uint32(math.MaxUint32), c.Workers.MaxFrameSize)
+	if _, err := parseTrustedProxies(strings.Join(c.TrustedProxies, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+
+	tls := c.TLS
+	check(tls.CertFile != "" || (tls.KeyFile == "" && tls.ClientCAFile == ""), "tls: key_file and client_ca_file need cert_file")
+	check(tls.CertFile == "" || tls.KeyFile != "", "tls: cert_file needs key_file")
+	check(!tls.RequireClientCert || tls.ClientCAFile != "", "tls.require_client_cert: needs client_ca_file")
+	check(tls.ReloadInterval > 0, "tls.reload_interval: must be positive, got %v", tls.ReloadInterval)
+
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio: must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	check(c.Tracing.Export == "" || c.Tracing.ServiceName != "", "tracing.service_name: must not be empty")
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format: must be text or json, got %q", c.Log.Format)
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %v", err))
+	}
+	check(c.Log.AdminPath == "" || (strings.HasPrefix(c.Log.AdminPath, "/") && c.Log.AdminPath != "/"), "log.admin_path: %q must be a path other than /", c.Log.AdminPath)
+
+	patterns := make([]string, 0, len(c.Routes))
+	for pattern := range c.Routes {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		route := c.Routes[pattern]
+		key := fmt.Sprintf("routes[%q]", pattern)
+		if _, err := typedefs.ParseRoute(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+		check(route.Timeout >= 0, "%s.timeout: must not be negative, got %v", key, route.Timeout)
+		check(route.MaxBodySize >= -1, "%s.max_body_size: must be -1 (no limit), 0 (inherit) or positive, got %d", key, route.MaxBodySize)
+		if route.CORS != nil {
+			errs = append(errs, route.CORS.validate(key+".cors"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *CORSConfig) validate(key string) error {
+	for _, method := range c.AllowMethods {
+		if !validMethod(method) {
+			return fmt.Errorf("%s.allow_methods: invalid method %q", key, method)
+		}
+	}
+	for _, origin := range c.AllowOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return fmt.Errorf("%s.allow_origins: %q is neither * nor an origin such as https://example.com", key, origin)
+		}
+	}
+	return nil
+}
+
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, r := range method {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// RouteTimeout returns the response timeout of requests matched to pattern.
+func (c *Config) RouteTimeout(pattern string) time.Duration {
+	if route, ok := c.Routes[pattern]; ok && route.Timeout > 0 {
+		return route.Timeout
+	}
+	return c.RequestTimeout
+}
+
+// RouteMaxBodySize returns the body limit of requests matched to pattern,
+// zero for no limit.
+func (c *Config) RouteMaxBodySize(pattern string) int64 {
+	if route, ok := c.Routes[pattern]; ok && route.MaxBodySize != 0 {
+		return max(route.MaxBodySize, 0)
+	}
+	return c.MaxBodySize
+}
+
+// RouteCORS returns the CORS policy of requests matched to pattern. An empty
+// pattern, for requests matching no route, gives the gateway's policy.
+func (c *Config) RouteCORS(pattern string) CORSConfig {
+	if route, ok := c.Routes[pattern]; ok && route.CORS != nil {
+		return *route.CORS
+	}
+	return c.CORS
+}
+
+// setupCORS adds the CORS headers of policy to the response. A list of
+// origins is matched against the request's Origin.
+func setupCORS(w http.ResponseWriter, r *http.Request, policy CORSConfig) {
+	origin := ""
+	for _, allowed := range policy.AllowOrigins {
+		if allowed == "*" {
+			origin = "*"
+			break
+		}
+		if allowed == r.Header.Get("Origin") {
+			origin = allowed
+		}
+	}
+	if len(policy.AllowOrigins) > 0 && origin != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+	if origin == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowHeaders, ", "))
+}
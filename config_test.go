@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig runs LoadConfig on args with the given environment. A
+// non-empty file is written to a temporary file, whose path replaces
+// $FILE in args and env.
+func loadTestConfig(t *testing.T, name, file string, env map[string]string, args ...string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if file != "" {
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = strings.ReplaceAll(arg, "$FILE", path)
+	}
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return LoadConfig(fs, expanded, func(key string) string {
+		return strings.ReplaceAll(env[key], "$FILE", path)
+	})
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	const (
+		yamlFile = "request_timeout: 1m\ncors:\n  allow_origins: [\"https://file.example.com\"]\n"
+		jsonFile = `{"request_timeout": "1m", "cors": {"allow_origins": ["https://file.example.com"]}}`
+	)
+	env := map[string]string{
+		"GATEWAY_REQUEST_TIMEOUT":    "2m",
+		"GATEWAY_CORS_ALLOW_ORIGINS": "https://env.example.com",
+	}
+	flags := []string{"-request-timeout", "3m", "-cors-allow-origins", "https://flag.example.com"}
+	tests := []struct {
+		name        string
+		fileName    string
+		file        string
+		env         map[string]string
+		args        []string
+		wantTimeout time.Duration
+		wantOrigins []string
+	}{
+		{"defaults", "gateway.yaml", "", nil, nil, 300 * time.Second, []string{"*"}},
+		{"YAML file", "gateway.yaml", yamlFile, nil, []string{"-config", "$FILE"}, time.Minute, []string{"https://file.example.com"}},
+		{"JSON file", "gateway.json", jsonFile, nil, []string{"-config", "$FILE"}, time.Minute, []string{"https://file.example.com"}},
+		{"file from env", "gateway.yaml", yamlFile, map[string]string{"GATEWAY_CONFIG": "$FILE"}, nil, time.Minute, []string{"https://file.example.com"}},
+		{"env over defaults", "gateway.yaml", "", env, nil, 2 * time.Minute, []string{"https://env.example.com"}},
+		{"env over file", "gateway.yaml", yamlFile, env, []string{"-config", "$FILE"}, 2 * time.Minute, []string{"https://env.example.com"}},
+		{"flags over defaults", "gateway.yaml", "", nil, flags, 3 * time.Minute, []string{"https://flag.example.com"}},
+		{"flags over file", "gateway.yaml", yamlFile, nil, append([]string{"-config", "$FILE"}, flags...), 3 * time.Minute, []string{"https://flag.example.com"}},
+		{"flags over env", "gateway.yaml", yamlFile, env, append([]string{"-config", "$FILE"}, flags...), 3 * time.Minute, []string{"https://flag.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := loadTestConfig(t, tt.fileName, tt.file, tt.env, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.RequestTimeout != tt.wantTimeout {
+				t.Errorf("got request_timeout %v, want %v", c.RequestTimeout, tt.wantTimeout)
+			}
+			if !reflect.DeepEqual(c.CORS.AllowOrigins, tt.wantOrigins) {
+				t.Errorf("got cors.allow_origins %v, want %v", c.CORS.AllowOrigins, tt.wantOrigins)
+			}
+			// Settings no layer sets keep their defaults
+			if c.TCPAddr != DefaultConfig().TCPAddr {
+				t.Errorf("got tcp_addr %q, want the default", c.TCPAddr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown file key", "request_timout: 1m\n", nil, []string{"-config", "$FILE"}, "request_timout"},
+		{"unknown nested file key", "heartbeat:\n  intervall: 5s\n", nil, []string{"-config", "$FILE"}, "intervall"},
+		{"bad file duration", "request_timeout: soon\n", nil, []string{"-config", "$FILE"}, "soon"},
+		{"bad env duration", "", map[string]string{"GATEWAY_REQUEST_TIMEOUT": "soon"}, nil, "GATEWAY_REQUEST_TIMEOUT"},
+		{"bad flag duration", "", nil, []string{"-request-timeout", "soon"}, "request-timeout"},
+		{"missing file", "", nil, []string{"-config", "$FILE"}, "gateway.yaml"},
+		{"invalid setting", "request_timeout: 0s\n", nil, []string{"-config", "$FILE"}, "request_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := loadTestConfig(t, "gateway.yaml", tt.file, tt.env, tt.args...)
+			if err == nil {
+				t.Fatalf("got %+v, want an error", c)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string // empty if the config is valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"bad http_addr", func(c *Config) { c.HTTPAddr = "8080" }, "http_addr"},
+		{"bad tcp_addr", func(c *Config) { c.TCPAddr = "localhost" }, "tcp_addr"},
+		{"bad grpc_addr", func(c *Config) { c.GRPCAddr = "" }, "grpc_addr"},
+		{"metrics disabled", func(c *Config) { c.MetricsPath = "" }, ""},
+		{"relative metrics_path", func(c *Config) { c.MetricsPath = "metrics" }, "metrics_path"},
+		{"root metrics_path", func(c *Config) { c.MetricsPath = "/" }, "metrics_path"},
+		{"zero request_timeout", func(c *Config) { c.RequestTimeout = 0 }, "request_timeout"},
+		{"negative shutdown_timeout", func(c *Config) { c.ShutdownTimeout = -time.Second }, "shutdown_timeout"},
+		{"negative max_body_size", func(c *Config) { c.MaxBodySize = -1 }, "max_body_size"},
+		{"bad cors method", func(c *Config) { c.CORS.AllowMethods = []string{"get"} }, "cors.allow_methods"},
+		{"bad cors origin", func(c *Config) { c.CORS.AllowOrigins = []string{"example.com"} }, "cors.allow_origins"},
+		{"unknown strategy", func(c *Config) { c.LoadBalancing.Strategy = "fastest" }, "load_balancing.strategy"},
+		{"negative heartbeat interval", func(c *Config) { c.Heartbeat.Interval = -time.Second }, "heartbeat.interval"},
+		{"no heartbeat misses", func(c *Config) { c.Heartbeat.Misses = 0 }, "heartbeat.misses"},
+		{"no write queue", func(c *Config) { c.Workers.WriteQueueSize = 0 }, "workers.write_queue_size"},
+		{"negative write_timeout", func(c *Config) { c.Workers.WriteTimeout = -time.Second }, "workers.write_timeout"},
+		{"zero max_frame_size", func(c *Config) { c.Workers.MaxFrameSize = 0 }, "workers.max_frame_size"},
+		{"oversize max_frame_size", func(c *Config) { c.Workers.MaxFrameSize = math.MaxUint32 + 1 }, "workers.max_frame_size"},
+		{"bad trusted proxy", func(c *Config) { c.TrustedProxies = []string{"proxy.local"} }, "trusted_proxies"},
+		{"key without cert", func(c *Config) { c.TLS.KeyFile = "gateway.key" }, "tls: key_file and client_ca_file need cert_file"},
+		{"client CA without cert", func(c *Config) { c.TLS.ClientCAFile = "ca.pem" }, "tls: key_file and client_ca_file need cert_file"},
+		{"cert without key", func(c *Config) { c.TLS.CertFile = "gateway.pem" }, "tls: cert_file needs key_file"},
+		{"client cert without CA", func(c *Config) {
+			c.TLS.CertFile, c.TLS.KeyFile, c.TLS.RequireClientCert = "gateway.pem", "gateway.key", true
+		}, "tls.require_client_cert"},
+		{"zero reload_interval", func(c *Config) { c.TLS.ReloadInterval = 0 }, "tls.reload_interval"},
+		{"sample_ratio above 1", func(c *Config) { c.Tracing.SampleRatio = 1.5 }, "tracing.sample_ratio"},
+		{"negative sample_ratio", func(c *Config) { c.Tracing.SampleRatio = -0.1 }, "tracing.sample_ratio"},
+		{"export without service_name", func(c *Config) {
+			c.Tracing.Export, c.Tracing.ServiceName = "spans.json", ""
+		}, "tracing.service_name"},
+		{"unknown log format", func(c *Config) { c.Log.Format = "xml" }, "log.format"},
+		{"unknown log level", func(c *Config) { c.Log.Level = "loud" }, "log.level"},
+		{"root admin_path", func(c *Config) { c.Log.AdminPath = "/" }, "log.admin_path"},
+		{"bad route pattern", func(c *Config) { c.Routes = map[string]RouteConfig{"ollama": {}} }, `routes["ollama"]`},
+		{"negative route timeout", func(c *Config) {
+			c.Routes = map[string]RouteConfig{"/ollama/*": {Timeout: -time.Second}}
+		}, `routes["/ollama/*"].timeout`},
+		{"bad route max_body_size", func(c *Config) {
+			c.Routes = map[string]RouteConfig{"/ollama/*": {MaxBodySize: -2}}
+		}, `routes["/ollama/*"].max_body_size`},
+		{"bad route cors", func(c *Config) {
+			c.Routes = map[string]RouteConfig{"/ollama/*": {CORS: &CORSConfig{AllowMethods: []string{"get"}}}}
+		}, `routes["/ollama/*"].cors.allow_methods`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.modify(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want one for %s", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %q, want it to mention %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := DefaultConfig()
+	c.MetricsPath = "/"
+	c.RequestTimeout = 0
+	c.Log.Format = "xml"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, key := range []string{"metrics_path", "request_timeout", "log.format"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not mention %s", err, key)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package demo contains the example callbacks served by cmd/client.
+package demo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"multichannel/cmd/callbacks"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/typedefs"
+	"multichannel/worker"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Register adds the demo callbacks to w.
+func Register(w *worker.Worker) {
+	w.Handle("/stocks", Stocks)
+	w.Handle("GET /stocks/{symbol}", Stock)
+	w.Handle("/weather", Weather)
+	w.Handle("/crypto", Crypto)
+	w.Handle("/ollama", Ollama)
+	w.Handle("/screenshot", callbacks.ScreenshotCallback)
+	w.HandleHTTP("/api/*", Router())
+}
+
+// Router is an ordinary gorilla/mux router, served through the tunnel as is
+// under /api/.
+func Router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/time", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"time": time.Now().Format(time.RFC3339)})
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/api/ticks", Ticks).Methods(http.MethodGet)
+	return r
+}
+
+// Ticks streams a server-sent event every second, five times
+func Ticks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher := w.(http.Flusher)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(w, "data: tick %d\n\n", i)
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stocks is the callback for /stocks
+func Stocks(ctx context.Context, req typedefs.Request) interface{} {
+	// Simulate a database query to retrieve stock data
+	stockData := []map[string]interface{}{
+		{"symbol": "AAPL", "price": 150.0},
+		{"symbol": "GOOG", "price": 2500.0},
+		{"symbol": "AMZN", "price": 3000.0},
+	}
+
+	return stockData
+}
+
+// Stock is the callback for GET /stocks/{symbol}
+func Stock(ctx context.Context, req typedefs.Request) interface{} {
+	symbol := strings.ToUpper(req.Param("symbol"))
+	for _, stock := range Stocks(ctx, req).([]map[string]interface{}) {
+		if stock["symbol"] == symbol {
+			return stock
+		}
+	}
+	return typedefs.NewErrorResponse(http.StatusNotFound, fmt.Errorf("unknown symbol %q", symbol))
+}
+
+// Weather is the callback for /weather
+func Weather(ctx context.Context, req typedefs.Request) interface{} {
+	// Simulate a weather API call to retrieve current weather conditions
+	weatherData := map[string]interface{}{
+		"temperature": 75.0,
+		"humidity":    60.0,
+		"conditions":  "Sunny",
+	}
+
+	return weatherData
+}
+
+// Crypto is the callback for /crypto
+func Crypto(ctx context.Context, req typedefs.Request) interface{} {
+	// Simulate a cryptocurrency API call to retrieve current prices
+	cryptoData := []map[string]interface{}{
+		{"symbol": "BTC", "price": 50000.0},
+		{"symbol": "ETH", "price": 4000.0},
+		{"symbol": "LTC", "price": 200.0},
+	}
+
+	return cryptoData
+}
+
+// Ollama is the callback for /ollama. It forwards generate requests to an
+// Ollama server and relays streamed generations as they arrive; the upstream
+// request is aborted when ctx is cancelled.
+func Ollama(ctx context.Context, req typedefs.Request) interface{} {
+	// Simulate a cryptocurrency API call to retrieve current prices
+
+	url := "http://192.168.1.10:11435/api/generate"
+	method := "POST"
+
+	var payload io.Reader = strings.NewReader(` {
+    "model": "mistral:latest",
+    "prompt": "best 10 country to live in ",
+    "stream":false
+}
+`)
+	// Forward the caller's generate request when one is given
+	if req.Stream || len(req.Body) > 0 {
+		payload = req.BodyReader
+	}
+
+	client := &http.Client{Transport: &logging.Transport{}}
+	reqllama, err := http.NewRequestWithContext(ctx, method, url, payload)
+
+	if err != nil {
+		return err
+	}
+	reqllama.Header.Add("Content-Type", "application/json")
+	reqllama.Header.Set(typedefs.RequestIDHeader, req.RequestId)
+
+	res, err := client.Do(reqllama)
+	if err != nil {
+		return err
+	}
+
+	// Streaming generations are relayed token by token as they arrive
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/x-ndjson") {
+		return &typedefs.Response{
+			StatusCode: int32(res.StatusCode),
+			Headers:    typedefs.Headers{"Content-Type": {res.Header.Get("Content-Type")}},
+			BodyReader: res.Body,
+		}
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		slog.Warn("Reading Ollama response failed", logging.RequestID, req.RequestId, "error", err)
+		return err
+	}
+	slog.Debug("Ollama response", logging.RequestID, req.RequestId, "status", res.StatusCode, "bytes", len(body))
+	return string(body)
+}
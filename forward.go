@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and Forwarded headers are believed. Requests from any
+// other peer have these headers rewritten from the connection itself.
+var trustedProxies []*net.IPNet
+
+// hopByHopHeaders apply to a single connection and are not forwarded, in
+// either direction (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or single IPs.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHopHeaders deletes hop-by-hop headers from h, including those the
+// Connection header names.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// forwardedFor returns the client addresses recorded by proxies in front of
+// the gateway, closest proxy last. The Forwarded header wins over
+// X-Forwarded-For when both are present.
+func forwardedFor(h http.Header) []string {
+	var addrs []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				addrs = append(addrs, forwardedNode(val))
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// forwardedNode strips the quotes, brackets and port from a Forwarded
+// "for" value such as "[2001:db8::1]:4711".
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+// clientIP determines the address of the original client. Forwarding
+// headers are only followed through trusted proxies: the list is walked from
+// the closest hop outwards and the first untrusted address is the client.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return peer
+}
+
+// correlationID returns the ID the caller knows r by: its X-Request-Id when
+// it sent a usable one, so its logs and ours line up, or requestId.
+func correlationID(r *http.Request, requestId string) string {
+	if id := r.Header.Get(typedefs.RequestIDHeader); typedefs.ValidRequestID(id) {
+		return id
+	}
+	return requestId
+}
+
+// forwardRequest builds the tunnelled form of r: the full URL, the
+// multi-valued end-to-end headers, and the client address, scheme and host
+// as seen by the first trusted proxy. X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host are set for the worker accordingly.
+func forwardRequest(r *http.Request) typedefs.Request {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	trusted := isTrustedProxy(peer)
+
+	header := r.Header.Clone()
+	removeHopHeaders(header)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if trusted {
+		if proto := header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		if fwdHost := header.Get("X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+	} else {
+		// Untrusted peers cannot vouch for anything before them
+		header.Del("Forwarded")
+		header.Del("X-Forwarded-For")
+	}
+
+	var xff []string
+	if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+		xff = append(xff, strings.Join(prior, ", "))
+	}
+	header.Set("X-Forwarded-For", strings.Join(append(xff, peer), ", "))
+	header.Set("X-Forwarded-Proto", scheme)
+	header.Set("X-Forwarded-Host", host)
+
+	request := typedefs.Request{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RawQuery:   r.URL.RawQuery,
+		Host:       host,
+		Scheme:     scheme,
+		Proto:      r.Proto,
+		RemoteAddr: clientIP(r),
+		Headers:    typedefs.Headers(header),
+	}
+	if r.TLS != nil {
+		request.TLS = &typedefs.TLSInfo{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+		}
+	}
+	return request
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"multichannel/cmd/typedefs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCorrelationID(t *testing.T) {
+	const requestId = "01HZX4T3QK8V6N0J2M5R7W9Y1B"
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"caller ID", "trace-42", "trace-42"},
+		{"no caller ID", "", requestId},
+		{"control characters", "bad\tid", requestId},
+		{"too long", strings.Repeat("x", typedefs.MaxRequestIDLength+1), requestId},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/items", nil)
+			if tt.header != "" {
+				r.Header.Set(typedefs.RequestIDHeader, tt.header)
+			}
+			if got := correlationID(r, requestId); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseManagerWriteKeepsCorrelationID(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set(typedefs.RequestIDHeader, "trace-42")
+	response := &ResponseManager{
+		Requestid:  "01HZX4T3QK8V6N0J2M5R7W9Y1B",
+		StatusCode: http.StatusCreated,
+		Headers:    typedefs.Headers{"X-Request-Id": {"upstream-7"}, "Content-Type": {"text/plain"}},
+		Response:   []byte("created"),
+	}
+	response.Write(w)
+	if got := w.Header().Get(typedefs.RequestIDHeader); got != "trace-42" {
+		t.Errorf("got X-Request-Id %q, want the caller's trace-42", got)
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != "created" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+}
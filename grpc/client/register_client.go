@@ -2,8 +2,12 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"google.golang.org/grpc"
-	"log"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"log/slog"
+	"multichannel/cmd/logging"
 	pb "multichannel/proto"
 )
 
@@ -12,8 +16,14 @@ type RegisterClient struct {
 	conn   *grpc.ClientConn
 }
 
-func NewRegisterClient(address string) (*RegisterClient, error) {
-	conn, err := grpc.Dial(address, grpc.WithInsecure())
+// NewRegisterClient connects to the gateway's gRPC service over TLS with
+// tlsConfig, or in plaintext when tlsConfig is nil.
+func NewRegisterClient(address string, tlsConfig *tls.Config) (*RegisterClient, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +53,7 @@ func (c *RegisterClient) Register(username, email, password string) (*pb.Registe
 	ctx := context.Background()
 	resp, err := c.client.Register(ctx, req)
 	if err != nil {
-		log.Printf("Error during registration: %v", err)
+		slog.Warn("Registration failed", "error", err)
 		return nil, err
 	}
 
@@ -59,7 +69,7 @@ func (c *RegisterClient) RegisterPath(clientID string, paths []string) (*pb.Regi
 	ctx := context.Background()
 	resp, err := c.client.RegisterPath(ctx, req)
 	if err != nil {
-		log.Printf("Error during path registration: %v", err)
+		slog.Warn("Path registration failed", logging.ClientID, clientID, "error", err)
 		return nil, err
 	}
 
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	pb "multichannel/proto"
+
+	"google.golang.org/grpc"
+)
+
+// localClient calls a RegisterServer in the same process through the
+// pb.RegisterServiceClient interface, without a network connection.
+type localClient struct {
+	server *RegisterServer
+}
+
+// Client returns a pb.RegisterServiceClient served directly by s. The
+// gateway's HTTP /register handler uses it, so it needs no credentials for
+// its own gRPC listener.
+func (s *RegisterServer) Client() pb.RegisterServiceClient {
+	return localClient{server: s}
+}
+
+func (c localClient) Register(ctx context.Context, in *pb.RegisterRequest, _ ...grpc.CallOption) (*pb.RegisterResponse, error) {
+	return c.server.Register(ctx, in)
+}
+
+func (c localClient) RegisterPath(ctx context.Context, in *pb.RegisterPathRequest, _ ...grpc.CallOption) (*pb.RegisterPathResponse, error) {
+	return c.server.RegisterPath(ctx, in)
+}
@@ -2,7 +2,8 @@ package server
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"multichannel/cmd/logging"
 	pb "multichannel/proto"
 )
 
@@ -43,7 +44,7 @@ func (s *RegisterServer) RegisterPath(ctx context.Context, req *pb.RegisterPathR
 
 	// Store the paths for this client
 	s.registeredPaths[req.ClientId] = req.Paths
-	log.Printf("Registered paths for client %s: %v", req.ClientId, req.Paths)
+	slog.Info("Registered paths", logging.ClientID, req.ClientId, "paths", req.Paths)
 
 	return &pb.RegisterPathResponse{
 		Success:         true,
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 type HttpClient struct {
@@ -18,6 +19,26 @@ func NewHttpClient() *HttpClient {
 	}
 }
 
+// NewProxyHttpClient returns a client for relaying requests unchanged:
+// redirects are handed back to the caller instead of being followed, and
+// timeout bounds each request (zero for none).
+func NewProxyHttpClient(timeout time.Duration) *HttpClient {
+	return &HttpClient{
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Do sends req and returns the response whatever its status code; the caller
+// must close the body.
+func (hc *HttpClient) Do(req *http.Request) (*http.Response, error) {
+	return hc.client.Do(req)
+}
+
 func (hc *HttpClient) Get(url string) ([]byte, error) {
 	resp, err := hc.client.Get(url)
 	if err != nil {
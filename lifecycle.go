@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Connection event types emitted by TCPManager.
+const (
+	EventConnected    = "connected"
+	EventRegistered   = "registered"
+	EventDraining     = "draining"
+	EventDisconnected = "disconnected"
+)
+
+// ConnectionEvent describes a change in a worker connection's lifecycle.
+type ConnectionEvent struct {
+	Type       string    `json:"type"`
+	ClientId   string    `json:"client_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Paths      []string  `json:"paths,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Failed     int       `json:"failed_requests,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// errHeartbeatTimeout is the disconnect reason for workers that stopped
+// answering heartbeats.
+var errHeartbeatTimeout = errors.New("missed heartbeats")
+
+// errGatewayShutdown is the disconnect reason for workers still connected
+// when the gateway stops.
+var errGatewayShutdown = errors.New("gateway shutting down")
+
+// drainPollInterval is how often Drain checks whether a draining worker's
+// requests have finished.
+const drainPollInterval = 50 * time.Millisecond
+
+// connState is the liveness state of a worker connection.
+type connState struct {
+	lastSeen  atomic.Int64   // unix nanos of the last frame received
+	rtt       atomic.Int64   // last heartbeat round trip in nanoseconds
+	heartbeat atomic.Bool    // the worker takes part in the heartbeat protocol
+	codec     typedefs.Codec // negotiated in REG, guarded by TCPManager.mu
+	flow      bool           // WINDOW flow control accepted in REG, guarded by TCPManager.mu
+	out       *outbound
+	closed    chan struct{}
+}
+
+func newConnState() *connState {
+	state := &connState{
+		codec:  typedefs.JSONCodec,
+		closed: make(chan struct{}),
+	}
+	state.lastSeen.Store(time.Now().UnixNano())
+	return state
+}
+
+// RTT returns the last measured heartbeat round trip time.
+func (s *connState) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+// OnEvent subscribes fn to connection events. Subscribers are called
+// synchronously and must not block.
+func (m *TCPManager) OnEvent(fn func(ConnectionEvent)) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, fn)
+	m.mu.Unlock()
+}
+
+func (m *TCPManager) emit(event ConnectionEvent) {
+	event.Time = time.Now()
+	m.mu.RLock()
+	listeners := m.listeners
+	m.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(event)
+	}
+}
+
+// Connect starts tracking a newly accepted worker connection and its
+// heartbeats.
+func (m *TCPManager) Connect(conn *net.Conn) {
+	state := newConnState()
+	state.out = newOutbound(conn, m.WriteQueueSize, m.WriteTimeout, state.closed)
+	m.mu.Lock()
+	m.conns[conn] = state
+	m.mu.Unlock()
+	go state.out.run(func(err error) { m.Disconnect(conn, err) })
+	if m.HeartbeatInterval > 0 {
+		go m.keepalive(conn, state)
+	}
+	m.emit(ConnectionEvent{
+		Type:       EventConnected,
+		RemoteAddr: (*conn).RemoteAddr().String(),
+	})
+}
+
+// Disconnect tears down a worker connection: it closes the socket, removes
+// the clients registered on it together with their routes, and fails their
+// in-flight requests with 502. It is safe to call more than once; only the
+// first call has any effect.
+func (m *TCPManager) Disconnect(conn *net.Conn, reason error) {
+	m.mu.Lock()
+	state, ok := m.conns[conn]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.conns, conn)
+	close(state.closed)
+	var removed []*TCPClient
+	for _, client := range m.Clients {
+		if client.Conn == conn {
+			m.removeLocked(client)
+			removed = append(removed, client)
+		}
+	}
+	m.mu.Unlock()
+
+	(*conn).Close()
+
+	failed := pending.FailConn(conn, func(requestId string) *ResponseManager {
+		return &ResponseManager{
+			Requestid:  requestId,
+			Response:   []byte("Worker connection lost"),
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Failed:     true,
+		}
+	})
+
+	event := ConnectionEvent{
+		Type:       EventDisconnected,
+		RemoteAddr: (*conn).RemoteAddr().String(),
+		Reason:     disconnectReason(reason),
+		Failed:     failed,
+	}
+	if len(removed) == 0 {
+		m.emit(event)
+	}
+	for _, client := range removed {
+		event.ClientId = client.ClientId
+		event.Paths = client.Paths
+		m.emit(event)
+		// Report failed requests once per connection
+		event.Failed = 0
+	}
+}
+
+// Drain stops routing requests to the clients registered on conn, for a
+// worker that sent DRAIN, and calls fn once the requests already routed to
+// them have finished. fn is not called if the connection closes first. The
+// connection itself stays open so those requests can still be answered.
+func (m *TCPManager) Drain(conn *net.Conn, fn func()) {
+	m.mu.Lock()
+	state, ok := m.conns[conn]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	var drained []*TCPClient
+	for _, client := range m.Clients {
+		if client.Conn == conn {
+			m.removeLocked(client)
+			drained = append(drained, client)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, client := range drained {
+		m.emit(ConnectionEvent{
+			Type:       EventDraining,
+			ClientId:   client.ClientId,
+			RemoteAddr: (*conn).RemoteAddr().String(),
+			Paths:      client.Paths,
+		})
+	}
+
+	// Workers are picked under their pool's lock, so once removed no new
+	// request slots are taken and the in-flight counts only go down
+	go func() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+		for {
+			busy := false
+			for _, client := range drained {
+				busy = busy || client.InFlight() > 0
+			}
+			if !busy {
+				fn()
+				return
+			}
+			select {
+			case <-state.closed:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown sends a SHUTDOWN frame to every connected worker, announcing
+// that the gateway closes the connections at deadline.
+func (m *TCPManager) Shutdown(deadline time.Time) {
+	for _, conn := range m.connList() {
+		if err := m.Writer(conn).WriteMessage(typedefs.NewShutdown(deadline)); err != nil {
+			connLogger(conn).Warn("Sending shutdown notice failed", "error", err)
+		}
+	}
+}
+
+// DisconnectAll tears down every worker connection.
+func (m *TCPManager) DisconnectAll(reason error) {
+	for _, conn := range m.connList() {
+		m.Disconnect(conn, reason)
+	}
+}
+
+func (m *TCPManager) connList() []*net.Conn {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	conns := make([]*net.Conn, 0, len(m.conns))
+	for conn := range m.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Seen records that a frame arrived on conn and handles heartbeat frames.
+func (m *TCPManager) Seen(conn *net.Conn, msg *typedefs.TcpMessage) {
+	m.mu.RLock()
+	state, ok := m.conns[conn]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+	state.lastSeen.Store(time.Now().UnixNano())
+
+	switch msg.Sub {
+	case "HEARTBEAT":
+		state.heartbeat.Store(true)
+		// A full queue means frames are flowing anyway; skip the answer
+		if err := m.Writer(conn).WriteMessage(typedefs.NewHeartbeatResponse(msg)); err != nil {
+			connLogger(conn).Debug("Not answering heartbeat", "error", err)
+		}
+	case "HEARTBEAT_RESPONSE":
+		state.heartbeat.Store(true)
+		rtt, err := typedefs.HeartbeatRTT(msg)
+		if err != nil {
+			connLogger(conn).Warn("Invalid heartbeat response", "error", err)
+			return
+		}
+		state.rtt.Store(int64(rtt))
+	}
+}
+
+// keepalive sends heartbeats on conn and tears it down once the worker has
+// been silent for HeartbeatMisses intervals. Workers that never took part in
+// the heartbeat protocol are not timed out.
+func (m *TCPManager) keepalive(conn *net.Conn, state *connState) {
+	ticker := time.NewTicker(m.HeartbeatInterval)
+	defer ticker.Stop()
+	limit := m.HeartbeatInterval * time.Duration(m.HeartbeatMisses)
+	for {
+		select {
+		case <-state.closed:
+			return
+		case <-ticker.C:
+			silence := time.Since(time.Unix(0, state.lastSeen.Load()))
+			if state.heartbeat.Load() && silence > limit {
+				m.Disconnect(conn, errHeartbeatTimeout)
+				return
+			}
+			if err := m.Writer(conn).WriteMessage(typedefs.NewHeartbeat()); err != nil {
+				connLogger(conn).Debug("Skipping heartbeat", "error", err)
+			}
+		}
+	}
+}
+
+// SetCodec records the codec a worker chose in REG. Frames written to conn
+// afterwards use it.
+func (m *TCPManager) SetCodec(conn *net.Conn, codec typedefs.Codec) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state, ok := m.conns[conn]; ok {
+		state.codec = codec
+	}
+}
+
+// SetFlowControl records that the worker on conn accepted WINDOW flow
+// control in REG.
+func (m *TCPManager) SetFlowControl(conn *net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state, ok := m.conns[conn]; ok {
+		state.flow = true
+	}
+}
+
+// FlowControl reports whether streamed bodies on conn use WINDOW flow
+// control.
+func (m *TCPManager) FlowControl(conn *net.Conn) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, ok := m.conns[conn]
+	return ok && state.flow
+}
+
+// Writer returns a frame writer for conn using the connection's codec.
+// Frames are queued for the connection's writer goroutine; writes fail with
+// ErrWriteQueueFull instead of blocking when the queue is full.
+func (m *TCPManager) Writer(conn *net.Conn) *typedefs.TcpMessageWriter {
+	return m.writer(conn, nil)
+}
+
+// StreamWriter is like Writer, but waits for room in the queue until done
+// is closed. It is meant for body chunks, which should be slowed down by a
+// busy worker rather than fail.
+func (m *TCPManager) StreamWriter(conn *net.Conn, done <-chan struct{}) *typedefs.TcpMessageWriter {
+	return m.writer(conn, done)
+}
+
+func (m *TCPManager) writer(conn *net.Conn, done <-chan struct{}) *typedefs.TcpMessageWriter {
+	m.mu.RLock()
+	state, ok := m.conns[conn]
+	m.mu.RUnlock()
+	if !ok {
+		return typedefs.NewTcpMessageWriter(closedWriter{})
+	}
+	var writer *typedefs.TcpMessageWriter
+	if done != nil {
+		writer = typedefs.NewTcpMessageWriter(state.out.Waiting(done))
+	} else {
+		writer = typedefs.NewTcpMessageWriter(state.out)
+	}
+	m.mu.RLock()
+	writer.SetCodec(state.codec)
+	m.mu.RUnlock()
+	return writer
+}
+
+// OnSent calls fn once the frames queued on conn so far have been written
+// to the socket. It reports false if that cannot be tracked; fn is then
+// never called.
+func (m *TCPManager) OnSent(conn *net.Conn, fn func()) bool {
+	m.mu.RLock()
+	state, ok := m.conns[conn]
+	m.mu.RUnlock()
+	return ok && state.out.OnSent(fn)
+}
+
+// RTT returns the last heartbeat round trip time measured on conn.
+func (m *TCPManager) RTT(conn *net.Conn) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if state, ok := m.conns[conn]; ok {
+		return state.RTT()
+	}
+	return 0
+}
+
+func disconnectReason(err error) string {
+	switch {
+	case err == nil:
+		return "closed"
+	case errors.Is(err, io.EOF):
+		return "closed by peer"
+	default:
+		return err.Error()
+	}
+}
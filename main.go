@@ -1,354 +1,847 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/tlsconfig"
+	"multichannel/cmd/tracing"
 	"multichannel/cmd/typedefs"
 	"multichannel/grpc/server"
 	"multichannel/http/handler"
 	pb "multichannel/proto"
 	"net"
 	"net/http"
-	"reflect"
+	"os"
+	"os/signal"
 	"strings"
-	_ "sync"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Llongfile)
-}
-
-// setupCORS adds CORS headers to the response
-func setupCORS(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-}
-
 // screenshotViewerHandler serves the screenshot viewer HTML page
 func screenshotViewerHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "web/static/screenshot.html")
+	http.ServeFile(w, r, config.ViewerFile)
 }
 
 var (
 	tcpmanager  = NewTCPManager()
 	serverblock = &ServerBlock{
-		Host:       "localhost",
-		HTTP:       8080,
-		TCP:        8081,
 		TCPManager: tcpmanager,
 	}
-	requestid int32 = 0
-	responses       = make(map[int]*ResponseManager)
+	pending = NewPendingRequests()
 )
 
 type ServerBlock struct {
-	Host       string
-	HTTP       int
-	TCP        int
+	HTTPAddr   string
+	TCPAddr    string
+	GRPCAddr   string
 	TCPManager *TCPManager
+	TLS        *tls.Config // TCP and gRPC listeners use TLS when set
+
+	mu          sync.Mutex
+	tcpListener net.Listener
+	closed      bool
 }
 
 type TCPClient struct {
-	ClientId string
-	Conn     *net.Conn
-	Paths    []string
+	ClientId       string
+	Conn           *net.Conn
+	Paths          []string
+	MaxConcurrency int    // requests the worker runs at once, zero if unlimited
+	Credential     string // identity the worker authenticated with, see authorizeRegistration
+	inFlight       atomic.Int64
+}
+
+// InFlight returns the number of requests currently routed to the client.
+func (c *TCPClient) InFlight() int64 {
+	return c.inFlight.Load()
+}
+
+// acquire reserves a request slot on the client. It fails when the worker
+// already runs as many requests as it advertised in REG.
+func (c *TCPClient) acquire() bool {
+	for {
+		n := c.inFlight.Load()
+		if c.MaxConcurrency > 0 && n >= int64(c.MaxConcurrency) {
+			return false
+		}
+		if c.inFlight.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release frees a slot reserved by acquire.
+func (c *TCPClient) release() {
+	c.inFlight.Add(-1)
 }
 
 type TCPManager struct {
-	Clients     map[string]*TCPClient // clientId -> client info
-	InvertedMap map[string]*net.Conn  // path -> connection
+	mu          sync.RWMutex
+	Clients     map[string]*TCPClient    // clientId -> client info
+	InvertedMap map[string]*WorkerPool   // route pattern -> workers serving it
+	Strategy    Strategy                 // strategy for newly created pools
+	HashHeader  string                   // request header hashed by HeaderHash
+	conns       map[*net.Conn]*connState // live worker connections
+	listeners   []func(ConnectionEvent)
+
+	HeartbeatInterval time.Duration // zero disables heartbeats
+	HeartbeatMisses   int           // silent intervals before teardown
+	MaxFrameSize      int           // largest frame payload accepted from workers
+	WriteQueueSize    int           // frames queued per worker before requests get 503
+	WriteTimeout      time.Duration // deadline for writing one frame to a worker
 }
 
 func NewTCPManager() *TCPManager {
 	return &TCPManager{
 		Clients:     make(map[string]*TCPClient),
-		InvertedMap: make(map[string]*net.Conn),
+		InvertedMap: make(map[string]*WorkerPool),
+		conns:       make(map[*net.Conn]*connState),
+		Strategy:    RoundRobin,
+		HashHeader:  "X-Session-Id",
+
+		HeartbeatInterval: 15 * time.Second,
+		HeartbeatMisses:   3,
+		MaxFrameSize:      typedefs.DefaultMaxFrameSize,
+		WriteQueueSize:    256,
+		WriteTimeout:      10 * time.Second,
 	}
 }
 
-func (m *TCPManager) Register(id string, paths []interface{}, conn *net.Conn) {
-	log.Println("Registering paths:", paths)
-	pathSlice := make([]string, len(paths))
-	for i, path := range paths {
-		pathSlice[i] = path.(string)
+// Register routes paths to the worker on conn. A worker registering again
+// with the same client ID replaces its previous registration, unless that
+// one was made with another credential, in which case Register fails with
+// ErrClientIdInUse.
+func (m *TCPManager) Register(id string, paths []interface{}, conn *net.Conn, maxConcurrency int, credential string) error {
+	pathSlice := make([]string, 0, len(paths))
+	routes := make([]*typedefs.Route, 0, len(paths))
+	for _, path := range paths {
+		pattern, _ := path.(string)
+		route, err := typedefs.ParseRoute(pattern)
+		if err != nil {
+			slog.Warn("Ignoring invalid route", logging.ClientID, id, "error", err)
+			continue
+		}
+		pathSlice = append(pathSlice, pattern)
+		routes = append(routes, route)
+	}
+
+	client := &TCPClient{
+		ClientId:       id,
+		Conn:           conn,
+		Paths:          pathSlice,
+		MaxConcurrency: maxConcurrency,
+		Credential:     credential,
 	}
 
-	m.Clients[id] = &TCPClient{
-		ClientId: id,
-		Conn:     conn,
-		Paths:    pathSlice,
+	m.mu.Lock()
+	// A re-registration replaces the client's previous routes
+	if previous, ok := m.Clients[id]; ok {
+		if previous.Credential != credential {
+			m.mu.Unlock()
+			return ErrClientIdInUse
+		}
+		m.removeLocked(previous)
 	}
-	log.Printf("Registered client with id: %s", id)
+	m.Clients[id] = client
 
-	// Update inverted map for quick path lookup
-	for _, path := range pathSlice {
-		m.InvertedMap[path] = conn
+	// Update inverted map for quick route lookup
+	for _, route := range routes {
+		pool, ok := m.InvertedMap[route.Pattern]
+		if !ok {
+			pool = NewWorkerPool(route, m.Strategy)
+			m.InvertedMap[route.Pattern] = pool
+		}
+		pool.Add(client)
 	}
-	serverblock.TCPManager = m
+	m.mu.Unlock()
+	slog.Info("Registered client", logging.ClientID, id, "paths", pathSlice, "max_concurrency", maxConcurrency)
+	m.emit(ConnectionEvent{
+		Type:       EventRegistered,
+		ClientId:   id,
+		RemoteAddr: (*conn).RemoteAddr().String(),
+		Paths:      pathSlice,
+	})
+	return nil
+}
+
+func (m *TCPManager) removeLocked(client *TCPClient) {
+	for _, path := range client.Paths {
+		if pool, ok := m.InvertedMap[path]; ok && pool.Remove(client) == 0 {
+			delete(m.InvertedMap, path)
+		}
+	}
+	if m.Clients[client.ClientId] == client {
+		delete(m.Clients, client.ClientId)
+	}
+}
+
+// Lookup resolves r to the most specific registered route, picks a worker
+// serving it and reserves a request slot on it, which the caller frees with
+// release. It returns the route and the request's path parameters. It fails
+// with ErrNoRoute when no route matches, typedefs.ErrMethodNotAllowed when
+// routes match the path but not the method, and ErrSaturated when all
+// workers for the route are at their advertised concurrency.
+func (m *TCPManager) Lookup(r *http.Request) (*TCPClient, *typedefs.Route, map[string]string, error) {
+	route, params, err := typedefs.MatchRoute(m.Routes(), r.Method, r.URL.Path)
+	if errors.Is(err, typedefs.ErrMethodNotAllowed) {
+		return nil, nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, nil, ErrNoRoute
+	}
+
+	m.mu.RLock()
+	pool, ok := m.InvertedMap[route.Pattern]
+	m.mu.RUnlock()
+	if !ok {
+		// The last worker for the route left in the meantime
+		return nil, nil, nil, ErrNoRoute
+	}
+	client, err := pool.Pick(r.Header.Get(m.HashHeader))
+	return client, route, params, err
+}
+
+// Routes returns a snapshot of the registered routes.
+func (m *TCPManager) Routes() []*typedefs.Route {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	routes := make([]*typedefs.Route, 0, len(m.InvertedMap))
+	for _, pool := range m.InvertedMap {
+		routes = append(routes, pool.Route())
+	}
+	return routes
+}
+
+// ClientList returns a snapshot of the registered clients.
+func (m *TCPManager) ClientList() []*TCPClient {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	clients := make([]*TCPClient, 0, len(m.Clients))
+	for _, client := range m.Clients {
+		clients = append(clients, client)
+	}
+	return clients
 }
 
 func (s *ServerBlock) TCPListen() {
-	log.Printf("Starting TCP server with port: %d", s.TCP)
-	address := fmt.Sprintf("127.0.0.1:%d", s.TCP)
-	log.Printf("Using server address: %s", address)
+	address := s.TCPAddr
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Printf("TCP server failed to start: %v", err)
+		slog.Error("TCP server failed to start", "addr", address, "error", err)
 		return
 	}
-	log.Printf("TCP server successfully started on %s", address)
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return
+	}
+	s.tcpListener = listener
+	s.mu.Unlock()
+	slog.Info("TCP server started", "addr", address, "tls", s.TLS != nil)
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			slog.Info("TCP server stopped", "addr", address)
+			return
+		}
 		if err != nil {
-			log.Printf("TCP connection error: %v", err)
+			slog.Warn("Accepting TCP connection failed", "error", err)
 			continue
 		}
-		writer := typedefs.NewTcpMessageWriter(conn)
-		// Send welcome message in JSON format
-		welcome := typedefs.TcpMessage{
-			Sub: "WELCOME",
-			Msg: []byte("Connected to TCP server"),
-		}
-		if err := writer.WriteMessage(&welcome); err != nil {
-			log.Printf("Error sending welcome message: %v", err)
-			continue
+		go s.accept(conn)
+	}
+}
+
+// CloseTCP stops accepting worker connections. Connected workers stay
+// connected.
+func (s *ServerBlock) CloseTCP() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+}
+
+// accept completes the TLS handshake of a new worker connection, greets it
+// and serves it.
+func (s *ServerBlock) accept(conn net.Conn) {
+	var hs handshake
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Warn("TLS handshake failed", logging.RemoteAddr, conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
 		}
-		go handleTCPConnection(&conn)
+		tlsConn.SetDeadline(time.Time{})
+		hs.subject = tlsconfig.PeerSubject(tlsConn.ConnectionState())
+	}
+
+	conn = meterConn(conn)
+	writer := typedefs.NewTcpMessageWriter(conn)
+	// Send welcome message in JSON format, offering the codecs a worker
+	// may switch to in REG and a challenge for HMAC credentials
+	var err error
+	if hs.challenge, err = typedefs.NewChallenge(); err != nil {
+		slog.Error("Creating challenge failed", logging.RemoteAddr, conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	hello, _ := json.Marshal(typedefs.Welcome{
+		Message:     "Connected to TCP server",
+		Codecs:      typedefs.CodecNames(),
+		Challenge:   hs.challenge,
+		FlowControl: true,
+	})
+	welcome := typedefs.TcpMessage{
+		Sub: "WELCOME",
+		Msg: hello,
 	}
+	if err := writer.WriteMessage(&welcome); err != nil {
+		slog.Warn("Sending welcome message failed", logging.RemoteAddr, conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	tcpmanager.Connect(&conn)
+	handleTCPConnection(&conn, &hs)
 }
 
-func handleTCPConnection(c *net.Conn) {
-	conn := *c
-	// defer conn.Close()
+func handleTCPConnection(conn *net.Conn, hs *handshake) {
+	var err error
+	defer func() { tcpmanager.Disconnect(conn, err) }()
+	reader := typedefs.NewTcpMessageReader(*conn)
+	reader.SetMaxFrameSize(tcpmanager.MaxFrameSize)
 	for {
-		err := handleTCPMessage(&conn)
+		err = handleTCPMessage(conn, reader, hs)
 		if err != nil {
 			if err == io.EOF {
-				log.Println("Connection closed by client")
+				connLogger(conn).Info("Connection closed by worker")
 				break
 			}
-			log.Printf("Error handling message: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				// Torn down by the gateway, which reported why
+				break
+			}
+			connLogger(conn).Warn("Closing worker connection", "error", err)
 			break
 		}
 	}
 }
 
-func handleTCPMessage(conn *net.Conn) error {
-	// Create a buffer to read data
-	reader := typedefs.NewTcpMessageReader(*conn)
+// errNotRegistered closes connections that send frames other than
+// preRegistration ones before registering.
+var errNotRegistered = errors.New("frame received before registration")
 
+var preRegistration = map[string]bool{
+	"REG":                true,
+	"register":           true,
+	"HEARTBEAT":          true,
+	"HEARTBEAT_RESPONSE": true,
+}
+
+func handleTCPMessage(conn *net.Conn, reader *typedefs.TcpMessageReader, hs *handshake) error {
 	msg, err := reader.ReadMessage()
 	if err != nil {
-		log.Printf("Error reading message: %v", err)
 		return err
 	}
+	tcpmanager.Seen(conn, msg)
+
+	// Until a REG is accepted the worker may only register and heartbeat
+	if !hs.registered && !preRegistration[msg.Sub] {
+		return fmt.Errorf("%w: %s", errNotRegistered, msg.Sub)
+	}
 
 	switch msg.Sub {
+	case "HEARTBEAT", "HEARTBEAT_RESPONSE":
+		// Answered and measured by tcpmanager.Seen
+
 	case "REG", "register":
 		// Cast the message to a map
 
 		var reg map[string]interface{}
 		err := json.Unmarshal(msg.Msg, &reg)
 		if err != nil {
-			log.Printf("Error unmarshalling registration message: %v", err)
+			connLogger(conn).Warn("Invalid registration message", "error", err)
 			return err
 		}
 
 		clientId, ok := reg["client_id"].(string)
 		if !ok {
-			log.Printf("Error getting client_id from registration")
+			connLogger(conn).Warn("Registration without client_id")
 			return nil
 		}
 
 		paths, ok := reg["Paths"].([]interface{})
 		if !ok {
-			log.Printf("Error getting paths from registration")
+			connLogger(conn).Warn("Registration without paths", logging.ClientID, clientId)
 			return nil
 		}
 
-		log.Printf("Registering client %s with paths: %v", clientId, paths)
-		tcpmanager.Register(clientId, paths, conn)
+		// Workers that do not advertise a limit are not capped by the gateway
+		maxConcurrency := 0
+		if n, ok := reg["max_concurrency"].(float64); ok && n > 0 {
+			maxConcurrency = int(n)
+		}
+
+		logger := connLogger(conn).With(logging.ClientID, clientId)
+		credential, rejection := authorizeRegistration(msg, hs, clientId, paths)
+		if rejection != nil {
+			logger.Warn("Rejecting registration", "code", rejection.Code, "reason", rejection.Reason)
+			tcpmanager.Reject(conn, rejection)
+			return rejection
+		}
+
+		if err := tcpmanager.Register(clientId, paths, conn, maxConcurrency, credential); err != nil {
+			rejection := &typedefs.Rejection{Code: typedefs.RejectClientIdInUse, Reason: err.Error()}
+			logger.Warn("Rejecting registration", "code", rejection.Code, "reason", rejection.Reason)
+			tcpmanager.Reject(conn, rejection)
+			return rejection
+		}
+		registrationsTotal.With("accepted").Inc()
+		hs.registered = true
+
+		// Workers that predate codec negotiation send no codec and keep JSON
+		if name, ok := reg["codec"].(string); ok {
+			codec, ok := typedefs.CodecByName(name)
+			if !ok {
+				logger.Warn("Unknown codec requested, keeping JSON", "codec", name)
+				codec = typedefs.JSONCodec
+			}
+			tcpmanager.SetCodec(conn, codec)
+		}
+		if flow, _ := reg["flow_control"].(bool); flow {
+			tcpmanager.SetFlowControl(conn)
+		}
 
 		response := typedefs.TcpMessage{
 			Sub: "REG_RESPONSE",
 			Msg: []byte("Registration successful"),
 		}
-		if err := json.NewEncoder(*conn).Encode(response); err != nil {
-			log.Printf("Error sending registration response: %v", err)
+		if err := tcpmanager.Writer(conn).WriteMessage(&response); err != nil {
+			logger.Warn("Sending registration response failed", "error", err)
 			return err
 		}
 
-	case "RESPONSE":
+	case "WINDOW":
+		n, err := typedefs.WindowSize(msg)
+		if err != nil {
+			connLogger(conn).Warn("Invalid window", logging.RequestID, msg.RequestId, "error", err)
+			return nil
+		}
+		if !pending.Grant(msg.RequestId, conn, n) {
+			connLogger(conn).Debug("Dropping frame for unknown or expired request", "type", msg.Sub, logging.RequestID, msg.RequestId)
+		}
+
+	case "DRAIN":
+		// The worker is stopping: route nothing new to it and tell it once
+		// the requests it was given have been answered
+		connLogger(conn).Info("Worker asked to drain")
+		tcpmanager.Drain(conn, func() {
+			if err := tcpmanager.Writer(conn).WriteMessage(typedefs.NewDrained()); err != nil {
+				connLogger(conn).Warn("Sending drained notice failed", "error", err)
+			}
+		})
+
+	case "RESPONSE", "ERROR":
 		// Handle response from client for HTTP request
 		if msg.Msg == nil {
-
-			log.Printf("Error getting response message")
+			connLogger(conn).Warn("Response without payload", logging.RequestID, msg.RequestId)
 			return nil
 		}
-		log.Println(reflect.TypeOf(msg.Msg).Kind().String())
 
-		responses[int(msg.RequestId)] = &ResponseManager{
-			Requestid:  int(msg.RequestId),
-			Response:   msg.Msg,
-			StatusCode: 200,
+		defaultStatus := http.StatusOK
+		if msg.Sub == "ERROR" {
+			connLogger(conn).Warn("Worker answered with an error", logging.RequestID, msg.RequestId, "error", string(msg.Msg))
+			defaultStatus = http.StatusInternalServerError
+		}
+		resp := msg.DecodeResponse(defaultStatus)
+		response := &ResponseManager{
+			Requestid:  msg.RequestId,
+			Response:   resp.Body,
+			StatusCode: int(resp.StatusCode),
+			Headers:    resp.Headers,
+			Streaming:  resp.Stream,
+			Duration:   resp.Duration,
 		}
 
-	case "ERROR":
-		log.Printf("Error message: %v", string(msg.Msg))
-		if msg.Msg == nil {
-
-			log.Printf("Error getting response message")
-			return nil
+		// Streamed responses stay pending until their END frame arrives
+		delivered := false
+		if resp.Stream {
+			delivered = pending.Deliver(msg.RequestId, conn, response)
+		} else {
+			delivered = pending.Resolve(msg.RequestId, conn, response)
 		}
-		var resp map[string]interface{}
-		err := json.Unmarshal(msg.Msg, &resp)
-		if err != nil {
-			log.Printf("Error unmarshalling error message: %v", err)
-			return err
+		if !delivered {
+			connLogger(conn).Debug("Dropping frame for unknown or expired request", "type", msg.Sub, logging.RequestID, msg.RequestId)
+		}
+
+	case "RESPONSE_CHUNK":
+		if !pending.Deliver(msg.RequestId, conn, &ResponseManager{
+			Requestid: msg.RequestId,
+			Response:  msg.Msg,
+		}) {
+			connLogger(conn).Debug("Dropping frame for unknown or expired request", "type", msg.Sub, logging.RequestID, msg.RequestId)
 		}
 
-		responses[int(msg.RequestId)] = &ResponseManager{
-			Requestid:  int(msg.RequestId),
-			Response:   []byte("error"),
-			StatusCode: 500,
+	case "END":
+		if !pending.Resolve(msg.RequestId, conn, &ResponseManager{
+			Requestid: msg.RequestId,
+			End:       true,
+		}) {
+			connLogger(conn).Debug("Dropping frame for unknown or expired request", "type", msg.Sub, logging.RequestID, msg.RequestId)
 		}
-		log.Println(reflect.TypeOf(msg.Msg).Kind().String())
 
 	default:
-		log.Printf("Unknown message type: %s", msg.Sub)
+		connLogger(conn).Warn("Unknown message type", "type", msg.Sub)
 	}
 	return nil
 }
 
+// connLogger returns the default logger with the worker connection's
+// address, and its client ID once registered.
+func connLogger(conn *net.Conn) *slog.Logger {
+	logger := slog.With(logging.RemoteAddr, (*conn).RemoteAddr().String())
+	for _, client := range tcpmanager.ClientList() {
+		if client.Conn == conn {
+			return logger.With(logging.ClientID, client.ClientId)
+		}
+	}
+	return logger
+}
+
 func WildRoute(w http.ResponseWriter, r *http.Request) {
-	// Add CORS headers
-	setupCORS(w)
-	
+	// Frames are keyed by an ID the gateway generates, so no caller can
+	// collide with another's request. Every answer carries the caller's own
+	// ID, if it sent one, and the log lines about the request both.
+	requestId := typedefs.NewRequestID()
+	correlationId := correlationID(r, requestId)
+	w.Header().Set(typedefs.RequestIDHeader, correlationId)
+
 	if r.Method == "OPTIONS" {
+		// Answer preflights with the CORS policy of the route the actual
+		// request would match
+		method := r.Header.Get("Access-Control-Request-Method")
+		if method == "" {
+			method = r.Method
+		}
+		pattern := ""
+		if route, _, err := typedefs.MatchRoute(tcpmanager.Routes(), method, r.URL.Path); err == nil {
+			pattern = route.Pattern
+		}
+		setupCORS(w, r, config.RouteCORS(pattern))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	if r.URL.Path == "/" {
-		// Redirect to screenshot viewer
-		http.Redirect(w, r, "/viewer", http.StatusFound)
+	if config.ViewerFile != "" && (r.URL.Path == "/" || r.URL.Path == "/viewer") {
+		setupCORS(w, r, config.CORS)
+		if r.URL.Path == "/" {
+			// Redirect to screenshot viewer
+			http.Redirect(w, r, "/viewer", http.StatusFound)
+			return
+		}
+		screenshotViewerHandler(w, r)
 		return
 	}
 
-	if r.URL.Path == "/viewer" {
-		screenshotViewerHandler(w, r)
-		return
+	start := time.Now()
+	logger := slog.With(logging.RequestID, requestId, logging.RemoteAddr, clientIP(r))
+	if correlationId != requestId {
+		logger = logger.With(logging.CorrelationID, correlationId)
 	}
+	logger.Debug("Request received", "method", r.Method, logging.Path, r.URL.Path, logging.Headers(r.Header))
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+	routeLabel := unmatchedRoute
+	span := tracer.Start(incomingTrace(r.Header), "gateway.request", tracing.SpanKindServer)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	defer func() {
+		status := recorder.status
+		if status == 0 {
+			// Nothing was written, e.g. the caller went away first
+			status = 499
+		}
+		elapsed := time.Since(start)
+		observeRequest(routeLabel, r.Method, status, elapsed)
+		endRequestSpan(span, routeLabel, status)
+		logger.Info("Request finished", "method", r.Method, logging.Path, r.URL.Path, "route", routeLabel,
+			"status", status, logging.Duration, elapsed)
+	}()
 
 	// Handle other paths
-	log.Printf("Searching for TCP handler for path: %s", r.URL.Path)
-	paths := strings.Split(r.URL.Path, "/")
-	if len(paths) < 2 {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Path not found"))
+	client, route, params, err := tcpmanager.Lookup(r)
+	pattern := ""
+	if err == nil {
+		pattern = route.Pattern
+		routeLabel = route.Pattern
+		requestsInFlight.With(routeLabel).Inc()
+		defer requestsInFlight.With(routeLabel).Dec()
+	}
+	setupCORS(w, r, config.RouteCORS(pattern))
+	if errors.Is(err, typedefs.ErrMethodNotAllowed) {
+		w.Header().Set("Allow", strings.Join(typedefs.AllowedMethods(tcpmanager.Routes(), r.URL.Path), ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed for this path"))
 		return
 	}
-
-	path := "/" + paths[1]
-	log.Printf("Looking up handler for path: %s", path)
-	conn, exists := tcpmanager.InvertedMap[path]
-	if !exists {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No handler registered for this path"))
+	if errors.Is(err, ErrSaturated) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("All workers for this path are busy"))
 		return
 	}
-
-	// Get request body
-	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error reading request body"))
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No handler registered for this path"))
 		return
 	}
+	conn := client.Conn
+	defer client.release()
+	path := route.Pattern
+	logger = logger.With(logging.ClientID, client.ClientId)
+	logger.Debug("Matched route", "route", path, logging.Path, r.URL.Path)
+
+	// Refuse bodies over the route's limit up front when their length is
+	// known; chunked ones are cut off once they exceed it
+	maxBodySize := config.RouteMaxBodySize(path)
+	if maxBodySize > 0 {
+		if r.ContentLength > maxBodySize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte("Request body too large"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
 
-	// Create headers map
-	headers := make(map[string]string)
-	for key, values := range r.Header {
-		if len(values) > 0 {
-			headers[key] = values[0]
+	// Small bodies travel inline; larger or chunked ones are streamed after
+	// the REQUEST frame so the gateway never holds them in memory.
+	stream := r.ContentLength < 0 || r.ContentLength > typedefs.ChunkSize
+	var body []byte
+	if !stream {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error reading request body"))
+			return
 		}
 	}
 
-	// Generate unique request ID
-	currentRequestId := atomic.AddInt32(&requestid, 1)
+	// Register before writing so a fast worker cannot answer before we
+	// listen
+	var credit *typedefs.Credit
+	flow := tcpmanager.FlowControl(conn)
+	if flow && stream {
+		credit = typedefs.NewCredit()
+	}
+	responseChan, ok := pending.Add(requestId, conn, credit)
+	if !ok {
+		// ULIDs do not repeat in practice
+		logger.Error("Request ID is already in flight")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Request ID collision"))
+		return
+	}
+	defer pending.Remove(requestId)
 
 	// Create TCP message
-	msg := typedefs.Request{
-		RequestId: currentRequestId,
-		Method:    r.Method,
-		Path:      r.URL.Path,
-		Headers:   headers,
-		Body:      body,
-	}
-	msgpayload, err := json.Marshal(msg)
-	if err != nil {
+	msg := forwardRequest(r)
+	msg.RequestId = requestId
+	msg.Headers[typedefs.RequestIDHeader] = []string{correlationId}
+	msg.Body = body
+	msg.Stream = stream
+	msg.Route = route.Pattern
+	msg.Params = params
+	// The worker continues the trace as a child of the forwarding span,
+	// which covers queueing, both wire hops and the worker's processing
+	forward := tracer.Start(span.Context(), "gateway.forward", tracing.SpanKindClient)
+	forward.SetAttribute("multichannel.client_id", client.ClientId)
+	forward.SetAttribute("multichannel.request_id", requestId)
+	defer forward.End()
+	propagate(&msg, forward.Context())
+	queue := tracer.Start(forward.Context(), "gateway.queue", tracing.SpanKindInternal)
+	defer queue.End()
+
+	err = tcpmanager.Writer(conn).WriteRequest(&msg)
+	if errors.Is(err, ErrWriteQueueFull) {
+		// The worker is not keeping up; shed load instead of queueing more
+		logger.Warn("Rejecting request", "error", err)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Worker is overloaded"))
 		return
 	}
-	tcpRequest := typedefs.TcpMessage{
-		Sub:       "REQUEST",
-		RequestId: currentRequestId,
-		Msg:       msgpayload,
-	}
-	writer := typedefs.NewTcpMessageWriter(*conn)
-
-	err = writer.WriteMessage(&tcpRequest)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Error("Sending request to worker failed", "error", err)
+		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte("Error sending TCP request"))
 		return
 	}
-	log.Printf("Sent request to client for path: %s with request ID: %d", path, currentRequestId)
+	// The queue span ends when the writer goroutine has put the frame on
+	// the socket
+	if queue.Recording() && !tcpmanager.OnSent(conn, queue.End) {
+		queue.End()
+	}
+	if stream {
+		writer := tcpmanager.StreamWriter(conn, r.Context().Done())
+		err := writer.WriteStreamCredit(requestId, "REQUEST_CHUNK", r.Body, credit, r.Context().Done())
+		if errors.Is(err, typedefs.ErrStreamStopped) {
+			// The worker answered, or the caller left, before the whole body was sent
+			logger.Debug("Stopped streaming request body", "error", err)
+		} else if err != nil {
+			logger.Warn("Streaming request body failed", "error", err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				tcpmanager.Cancel(conn, requestId)
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte("Request body too large"))
+				return
+			}
+		}
+	}
+	logger.Debug("Sent request to worker", "route", path)
+
+	// Unless the worker finished or is gone, tell it to stop working on a
+	// request nobody waits for anymore
+	finished := false
+	defer func() {
+		if !finished {
+			tcpmanager.Cancel(conn, requestId)
+			logger.Debug("Cancelled request on worker")
+		}
+	}()
 
-	// Wait for response with timeout
-	timeout := time.After(300 * time.Second)
-	ticker := time.NewTicker(1 * time.Millisecond)
-	defer ticker.Stop()
+	// Wait for response with timeout. For streamed responses the timeout is
+	// reset by every chunk, so it bounds idle time rather than total time.
+	requestTimeout := config.RouteTimeout(path)
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
 
+	flusher, _ := w.(http.Flusher)
+	streaming := false
+	var receipts typedefs.Receipts
 	for {
 		select {
-		case <-timeout:
-			w.WriteHeader(http.StatusGatewayTimeout)
-			w.Write([]byte("Request timed out"))
-			return
-		case <-ticker.C:
-			if response, ok := responses[int(currentRequestId)]; ok {
-
-				w.WriteHeader(response.StatusCode)
-				w.Header().Set("content-type", "application/json")
-				w.Write(response.Response)
-				delete(responses, int(currentRequestId)) // Clean up
+		case response := <-responseChan:
+			if !streaming && !response.Failed && !response.Overflow {
+				// Response head
+				recordWireTime(forward, queue, response.Duration)
+				if response.Duration > 0 {
+					workerDuration.With(path).Observe(response.Duration.Seconds())
+				}
+			}
+			switch {
+			case response.Failed:
+				forward.SetError("worker connection lost")
+				finished = true
+				if !streaming {
+					response.Write(w)
+				}
+				return
+			case response.Overflow:
+				// Leave finished unset so the worker is told to stop
+				forward.SetError("caller fell behind the response")
+				logger.Warn("Caller fell behind the response, cancelling it", "buffered_frames", streamBuffer)
+				if !streaming {
+					response.Write(w)
+				}
+				return
+			case response.End:
+				finished = true
 				return
+			case response.Streaming:
+				streaming = true
+				response.Write(w)
+			case streaming:
+				if _, err := w.Write(response.Response); err != nil {
+					logger.Debug("Writing response chunk failed", "error", err)
+					return
+				}
+				// The caller took the chunk; let the worker send another
+				if n := receipts.Consume(); flow && n > 0 {
+					window := tcpmanager.StreamWriter(conn, r.Context().Done())
+					if err := window.WriteMessage(typedefs.NewWindow(requestId, n)); err != nil {
+						logger.Debug("Granting response window failed", "error", err)
+					}
+				}
+			default:
+				finished = true
+				response.Write(w)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if !timeout.Stop() {
+				<-timeout.C
 			}
+			timeout.Reset(requestTimeout)
+		case <-timeout.C:
+			forward.SetError("timed out waiting for the worker")
+			logger.Warn("Timed out waiting for the worker", "timeout", requestTimeout)
+			if !streaming {
+				w.WriteHeader(http.StatusGatewayTimeout)
+				w.Write([]byte("Request timed out"))
+			}
+			return
+		case <-r.Context().Done():
+			logger.Info("Caller went away before the response")
+			return
 		}
 	}
 }
 
+// Cancel sends a CANCEL frame for requestId so the worker can abort its
+// callback.
+func (m *TCPManager) Cancel(conn *net.Conn, requestId string) {
+	cancel := typedefs.TcpMessage{
+		Sub:       "CANCEL",
+		RequestId: requestId,
+	}
+	if err := m.Writer(conn).WriteMessage(&cancel); err != nil {
+		slog.Warn("Cancelling request failed", logging.RequestID, requestId, "error", err)
+	}
+}
+
 func ClientsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Create a more readable response structure
 	type ClientInfo struct {
-		ClientId string   `json:"client_id"`
-		Paths    []string `json:"registered_paths"`
+		ClientId       string   `json:"client_id"`
+		Paths          []string `json:"registered_paths"`
+		InFlight       int64    `json:"in_flight"`
+		MaxConcurrency int      `json:"max_concurrency,omitempty"`
+		RTT            float64  `json:"rtt_ms"`
 	}
 
 	clientList := make([]ClientInfo, 0)
-	for _, client := range tcpmanager.Clients {
+	for _, client := range tcpmanager.ClientList() {
 		clientList = append(clientList, ClientInfo{
-			ClientId: client.ClientId,
-			Paths:    client.Paths,
+			ClientId:       client.ClientId,
+			Paths:          client.Paths,
+			InFlight:       client.InFlight(),
+			MaxConcurrency: client.MaxConcurrency,
+			RTT:            float64(tcpmanager.RTT(client.Conn)) / float64(time.Millisecond),
 		})
 	}
 
@@ -359,63 +852,166 @@ func ClientsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	var err error
+	if config, err = LoadConfig(flag.CommandLine, os.Args[1:], os.Getenv); err != nil {
+		logging.Fatal("Invalid configuration", "error", err)
+	}
+	logLevel, err := logging.Setup(config.Log.Format, config.Log.Level)
+	if err != nil {
+		logging.Fatal("Invalid log configuration", "error", err)
+	}
+	serverblock.HTTPAddr = config.HTTPAddr
+	serverblock.TCPAddr = config.TCPAddr
+	serverblock.GRPCAddr = config.GRPCAddr
+	tcpmanager.Strategy, _ = ParseStrategy(config.LoadBalancing.Strategy)
+	tcpmanager.HashHeader = config.LoadBalancing.HashHeader
+	tcpmanager.HeartbeatInterval = config.Heartbeat.Interval
+	tcpmanager.HeartbeatMisses = config.Heartbeat.Misses
+	tcpmanager.WriteQueueSize = config.Workers.WriteQueueSize
+	tcpmanager.WriteTimeout = config.Workers.WriteTimeout
+	tcpmanager.MaxFrameSize = config.Workers.MaxFrameSize
+	trustedProxies, _ = parseTrustedProxies(strings.Join(config.TrustedProxies, ","))
+
+	if config.AuthPolicy != "" {
+		if authPolicy, err = LoadAuthPolicy(config.AuthPolicy); err != nil {
+			logging.Fatal("Invalid auth_policy", "error", err)
+		}
+		slog.Info("Workers must authenticate", "credentials", len(authPolicy.Credentials), "auth_policy", config.AuthPolicy)
+	} else {
+		slog.Warn("No auth_policy configured: any worker may register any path")
+	}
+
+	if config.TLS.CertFile != "" {
+		reloader, err := tlsconfig.NewReloader(tlsconfig.Files{
+			CertFile: config.TLS.CertFile,
+			KeyFile:  config.TLS.KeyFile,
+			CAFile:   config.TLS.ClientCAFile,
+		})
+		if err != nil {
+			logging.Fatal("Invalid TLS configuration", "error", err)
+		}
+		go reloader.Watch(config.TLS.ReloadInterval, nil)
+		serverblock.TLS = reloader.ServerConfig(config.TLS.RequireClientCert)
+	}
+
+	if config.Tracing.Export != "" {
+		exporter, err := tracing.NewExporter(config.Tracing.Export)
+		if err != nil {
+			logging.Fatal("Invalid tracing.export", "error", err)
+		}
+		defer exporter.Close()
+		tracer = tracing.NewTracer(config.Tracing.ServiceName, exporter, config.Tracing.SampleRatio)
+		slog.Info("Exporting traces", "target", config.Tracing.Export)
+	}
+
+	tcpmanager.OnEvent(func(event ConnectionEvent) {
+		slog.Info("Worker "+event.Type, logging.ClientID, event.ClientId, logging.RemoteAddr, event.RemoteAddr,
+			"paths", event.Paths, "reason", event.Reason, "failed_requests", event.Failed)
+	})
+
 	// Start TCP server
 	go serverblock.TCPListen()
 
 	// Start gRPC server
-	lis, err := net.Listen("tcp", ":50051")
+	lis, err := net.Listen("tcp", serverblock.GRPCAddr)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		logging.Fatal("gRPC listener failed", "addr", serverblock.GRPCAddr, "error", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	var grpcOpts []grpc.ServerOption
+	if serverblock.TLS != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(serverblock.TLS)))
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
 	registerServer := server.NewRegisterServer()
 	pb.RegisterRegisterServiceServer(grpcServer, registerServer)
 
 	go func() {
-		log.Printf("Starting gRPC server on :50051")
+		slog.Info("Starting gRPC server", "addr", serverblock.GRPCAddr)
 		if err := grpcServer.Serve(lis); err != nil {
-			log.Fatalf("failed to serve: %v", err)
+			logging.Fatal("gRPC server failed", "error", err)
 		}
 	}()
 
-	// Create gRPC client connection for HTTP handler
-	conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("failed to connect to gRPC server: %v", err)
-	}
-	defer conn.Close()
-
-	grpcClient := pb.NewRegisterServiceClient(conn)
-	registerHandler := handler.NewRegisterHandler(grpcClient)
+	// The HTTP handler calls the register service in-process
+	registerHandler := handler.NewRegisterHandler(registerServer.Client())
 
 	// Setup HTTP server
 	http.HandleFunc("/register", registerHandler.Handle)
 	http.HandleFunc("/clients", ClientsHandler)
+	if config.MetricsPath != "" {
+		http.Handle(config.MetricsPath, gatewayMetrics)
+	}
+	if config.Log.AdminPath != "" && config.Log.AdminToken != "" {
+		http.Handle(config.Log.AdminPath, logging.RequireToken(config.Log.AdminToken, logging.LevelHandler(logLevel)))
+	}
 	http.HandleFunc("/", WildRoute)
 
 	// Start HTTP server
-	log.Printf("Starting HTTP server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("failed to serve HTTP: %v", err)
-	}
+	httpServer := &http.Server{Addr: serverblock.HTTPAddr}
+	go func() {
+		slog.Info("Starting HTTP server", "addr", serverblock.HTTPAddr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("HTTP server failed", "error", err)
+		}
+	}()
+
+	// Serve until SIGTERM or Ctrl-C, then drain; a second signal kills the
+	// gateway at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shutdown(httpServer, grpcServer, config.ShutdownTimeout)
 }
 
 type ResponseManager struct {
-	Requestid  int
+	Requestid  string
 	Response   []byte
 	StatusCode int
+	Headers    typedefs.Headers
+	Streaming  bool          // body continues in RESPONSE_CHUNK frames
+	End        bool          // END frame of a streamed response
+	Failed     bool          // the worker connection was lost
+	Overflow   bool          // the caller fell too far behind a streamed response
+	Duration   time.Duration // worker-reported time before the response head
 }
 
-func tcpMessageHandler(conn *net.Conn) error {
+// Write replays the worker's status, headers and body on w. Headers from the
+// worker replace any of the same name already set by the gateway.
+func (rm *ResponseManager) Write(w http.ResponseWriter) {
+	header := w.Header()
+	// The caller correlates by the ID the gateway echoes, not whatever ID a
+	// worker's upstream answered with
+	correlationId := header.Get(typedefs.RequestIDHeader)
+	for key, values := range rm.Headers {
+		header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	// Hop-by-hop headers are never replayed to the HTTP caller, and the
+	// length is recomputed by net/http
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+	if correlationId != "" {
+		header.Set(typedefs.RequestIDHeader, correlationId)
+	}
+	status := rm.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(rm.Response); err != nil {
+		slog.Debug("Writing response failed", logging.RequestID, rm.Requestid, "error", err)
+	}
+}
 
-	log.Printf("[%s] Handling new message from %s", (*conn).RemoteAddr())
+func tcpMessageHandler(conn *net.Conn) error {
+	logger := slog.With(logging.RemoteAddr, (*conn).RemoteAddr().String())
+	logger.Debug("Handling new message")
 
 	reader := typedefs.NewTcpMessageReader(*conn)
 	writer := typedefs.NewTcpMessageWriter(*conn)
 	msg, err := reader.ReadMessage()
 	if err != nil {
-		log.Printf("[%s] Error reading message from %s: %v", (*conn).RemoteAddr(), err)
+		logger.Warn("Reading message failed", "error", err)
 		return err
 	}
 	switch msg.Sub {
@@ -423,48 +1019,54 @@ func tcpMessageHandler(conn *net.Conn) error {
 		var reg map[string]interface{}
 		err := json.Unmarshal(msg.Msg, &reg)
 		if err != nil {
-			log.Printf("[%s] Error unmarshalling registration message: %v", err)
+			logger.Warn("Invalid registration message", "error", err)
 			return err
 		}
 
 		clientId, ok := reg["client_id"].(string)
 		if !ok {
-			log.Printf("[%s] Error getting client_id from registration")
+			logger.Warn("Registration without client_id")
 			return nil
 		}
 
 		paths, ok := reg["Paths"].([]interface{})
 		if !ok {
-			log.Printf("[%s] Error getting paths from registration")
+			logger.Warn("Registration without paths", logging.ClientID, clientId)
 			return nil
 		}
 
-		log.Printf("[%s] Registering client %s with paths: %v", clientId, paths)
-		tcpmanager.Register(clientId, paths, conn)
+		// This handler predates worker authentication
+		if authPolicy != nil {
+			return errors.New("registration requires authentication")
+		}
+		logger = logger.With(logging.ClientID, clientId)
+		if err := tcpmanager.Register(clientId, paths, conn, 0, ""); err != nil {
+			return err
+		}
 
 		response := typedefs.TcpMessage{
 			Sub: "REG_RESPONSE",
 			Msg: []byte("Registration successful"),
 		}
 		if err := writer.WriteMessage(&response); err != nil {
-			log.Printf("[%s] Error sending registration response: %v", err)
+			logger.Warn("Sending registration response failed", "error", err)
 			return err
 		}
-		log.Println("Registered client with id", clientId, "messege sent to client")
+		logger.Debug("Registration response sent")
 
 	case "HEARTBEAT":
-		log.Printf("[%s] Received heartbeat from %s", (*conn).RemoteAddr())
+		logger.Debug("Received heartbeat")
 		response := typedefs.TcpMessage{
 			Sub: "HEARTBEAT_RESPONSE",
 			Msg: []byte("Heartbeat acknowledged"),
 		}
 		if err := writer.WriteMessage(&response); err != nil {
-			log.Printf("[%s] Error sending heartbeat response: %v", err)
+			logger.Warn("Sending heartbeat response failed", "error", err)
 			return err
 		}
 
 	default:
-		log.Printf("[%s] Unknown message type: %s", msg.Sub)
+		logger.Warn("Unknown message type", "type", msg.Sub)
 	}
 	return nil
 }
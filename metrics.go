@@ -0,0 +1,102 @@
+package main
+
+import (
+	"multichannel/cmd/metrics"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Gateway metrics, served at config.MetricsPath. Requests are labelled with
+// the route pattern they matched, or "unmatched", so the number of series
+// stays bounded by the routes workers register.
+var (
+	gatewayMetrics = metrics.NewRegistry()
+
+	requestsTotal = gatewayMetrics.NewCounterVec("multichannel_gateway_requests_total",
+		"HTTP requests handled by the wildcard route, by status class.", "route", "method", "code")
+	requestDuration = gatewayMetrics.NewHistogramVec("multichannel_gateway_request_duration_seconds",
+		"Time from receiving a request to the end of its response, as seen by the gateway.", metrics.DefaultBuckets, "route")
+	workerDuration = gatewayMetrics.NewHistogramVec("multichannel_gateway_worker_duration_seconds",
+		"Time workers report spending on a request before sending the response head.", metrics.DefaultBuckets, "route")
+	requestsInFlight = gatewayMetrics.NewGaugeVec("multichannel_gateway_requests_in_flight",
+		"Requests forwarded to a worker and not yet answered.", "route")
+	frameBytes = gatewayMetrics.NewCounterVec("multichannel_gateway_frame_bytes_total",
+		"Bytes of TCP frames received from (in) and sent to (out) workers.", "direction")
+	registrationsTotal = gatewayMetrics.NewCounterVec("multichannel_gateway_registrations_total",
+		"Worker registrations, by result: accepted or the rejection code.", "result")
+)
+
+const unmatchedRoute = "unmatched"
+
+func init() {
+	gatewayMetrics.NewGaugeFunc("multichannel_gateway_connected_clients",
+		"Registered worker clients.", func() float64 {
+			tcpmanager.mu.RLock()
+			defer tcpmanager.mu.RUnlock()
+			return float64(len(tcpmanager.Clients))
+		})
+	gatewayMetrics.NewGaugeFunc("multichannel_gateway_worker_connections",
+		"Open worker TCP connections, registered or not.", func() float64 {
+			tcpmanager.mu.RLock()
+			defer tcpmanager.mu.RUnlock()
+			return float64(len(tcpmanager.conns))
+		})
+	gatewayMetrics.NewGaugeFunc("multichannel_gateway_routes",
+		"Route patterns served by at least one worker.", func() float64 {
+			tcpmanager.mu.RLock()
+			defer tcpmanager.mu.RUnlock()
+			return float64(len(tcpmanager.InvertedMap))
+		})
+}
+
+// meterConn counts the frame bytes exchanged on a worker connection.
+func meterConn(conn net.Conn) net.Conn {
+	return &metrics.Conn{Conn: conn, In: frameBytes.With("in"), Out: frameBytes.With("out")}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// observeRequest records a finished request.
+func observeRequest(route, method string, status int, elapsed time.Duration) {
+	requestsTotal.With(route, methodLabel(method), metrics.StatusClass(status)).Inc()
+	requestDuration.With(route).Observe(elapsed.Seconds())
+}
+
+// methodLabel keeps arbitrary methods from creating new series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	// ErrWriteQueueFull is returned when a worker connection has more frames
+	// waiting to be written than its queue holds.
+	ErrWriteQueueFull = errors.New("worker write queue is full")
+	// ErrConnClosed is returned for writes to a connection that was torn down.
+	ErrConnClosed = errors.New("worker connection closed")
+)
+
+// outbound serialises the frames written to a worker connection. Frames are
+// queued by any goroutine and written in order by a single writer goroutine,
+// so frames never interleave and a slow worker blocks only its own queue.
+//
+// outbound implements io.Writer for use with typedefs.TcpMessageWriter; each
+// Write call must carry exactly one frame.
+type outbound struct {
+	conn    *net.Conn
+	queue   chan outFrame
+	timeout time.Duration // write deadline per frame, zero for none
+	closed  <-chan struct{}
+}
+
+func newOutbound(conn *net.Conn, size int, timeout time.Duration, closed <-chan struct{}) *outbound {
+	return &outbound{
+		conn:    conn,
+		queue:   make(chan outFrame, size),
+		timeout: timeout,
+		closed:  closed,
+	}
+}
+
+// Write queues a frame without blocking and fails with ErrWriteQueueFull
+// when there is no room.
+func (o *outbound) Write(frame []byte) (int, error) {
+	select {
+	case <-o.closed:
+		return 0, ErrConnClosed
+	default:
+	}
+	select {
+	case o.queue <- outFrame{data: append([]byte(nil), frame...)}:
+		return len(frame), nil
+	case <-o.closed:
+		return 0, ErrConnClosed
+	default:
+		return 0, ErrWriteQueueFull
+	}
+}
+
+// Flush waits up to timeout until the frames queued so far are written. It
+// is used before closing a connection on purpose.
+func (o *outbound) Flush(timeout time.Duration) error {
+	flushed := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o.queue <- outFrame{marker: func() { close(flushed) }}:
+	case <-o.closed:
+		return ErrConnClosed
+	case <-timer.C:
+		return ErrWriteQueueFull
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-o.closed:
+		return ErrConnClosed
+	case <-timer.C:
+		return errors.New("flush timed out")
+	}
+}
+
+// OnSent arranges for fn to be called by the writer goroutine once the
+// frames queued so far are written. It reports false, without calling fn,
+// if the queue has no room.
+func (o *outbound) OnSent(fn func()) bool {
+	select {
+	case o.queue <- outFrame{marker: fn}:
+		return true
+	default:
+		return false
+	}
+}
+
+// outFrame is a queued frame, or a marker called when it is reached.
+type outFrame struct {
+	data   []byte
+	marker func()
+}
+
+// Waiting returns a writer that waits for room in the queue until done is
+// closed, for streams that should slow down rather than fail.
+func (o *outbound) Waiting(done <-chan struct{}) *waitingWriter {
+	return &waitingWriter{o: o, done: done}
+}
+
+type waitingWriter struct {
+	o    *outbound
+	done <-chan struct{}
+}
+
+func (w *waitingWriter) Write(frame []byte) (int, error) {
+	select {
+	case w.o.queue <- outFrame{data: append([]byte(nil), frame...)}:
+		return len(frame), nil
+	case <-w.o.closed:
+		return 0, ErrConnClosed
+	case <-w.done:
+		return 0, errors.New("write abandoned")
+	}
+}
+
+// run writes queued frames until the connection is closed. A failed or
+// timed out write tears the connection down via fail.
+func (o *outbound) run(fail func(error)) {
+	for {
+		select {
+		case <-o.closed:
+			return
+		case frame := <-o.queue:
+			if frame.marker != nil {
+				frame.marker()
+				continue
+			}
+			if o.timeout > 0 {
+				(*o.conn).SetWriteDeadline(time.Now().Add(o.timeout))
+			}
+			if _, err := (*o.conn).Write(frame.data); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+}
+
+// closedWriter rejects every write; it stands in for connections that are
+// no longer tracked.
+type closedWriter struct{}
+
+func (closedWriter) Write([]byte) (int, error) { return 0, ErrConnClosed }
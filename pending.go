@@ -0,0 +1,163 @@
+package main
+
+import (
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// PendingRequests tracks in-flight tunnelled HTTP requests by request ID and
+// hands each of them its own completion channel.
+type PendingRequests struct {
+	mu      sync.Mutex
+	waiters map[string]*pendingRequest
+}
+
+type pendingRequest struct {
+	conn      *net.Conn // worker connection the request was sent on
+	responses chan *ResponseManager
+	credit    *typedefs.Credit // for the streamed request body, nil without flow control
+}
+
+// stop ends the request body once the worker answers or the request leaves
+// the table, so the gateway stops waiting for credit the worker will never
+// grant. Like net/http, the gateway does not send the rest of a body once
+// the response has started.
+func (req *pendingRequest) stop() {
+	if req.credit != nil {
+		req.credit.Close()
+	}
+}
+
+// streamBuffer is the number of response frames buffered per request: a
+// flow control window of chunks, the response head and END. A caller that
+// falls further behind a streamed response, because the worker does not
+// use flow control, is cut off so one slow reader never holds up the other
+// requests on the worker connection.
+const streamBuffer = typedefs.StreamWindow + 2
+
+func NewPendingRequests() *PendingRequests {
+	return &PendingRequests{
+		waiters: make(map[string]*pendingRequest),
+	}
+}
+
+// Add registers a request ID sent on conn and returns the channel its response
+// frames will be delivered on. WINDOW grants from the worker for the request
+// body are added to credit, if not nil. Add reports false, and registers
+// nothing, when the ID is already in flight. Callers must Remove the ID once
+// they stop listening.
+func (p *PendingRequests) Add(requestId string, conn *net.Conn, credit *typedefs.Credit) (<-chan *ResponseManager, bool) {
+	req := &pendingRequest{
+		conn:   conn,
+		credit: credit,
+		// One slot more than Deliver fills, kept for the final failure
+		responses: make(chan *ResponseManager, streamBuffer+1),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.waiters[requestId]; ok {
+		return nil, false
+	}
+	p.waiters[requestId] = req
+	return req.responses, true
+}
+
+// Deliver hands a frame of a streamed response, received on conn, to the
+// waiting request and keeps it in the table. It never blocks: once the caller
+// is streamBuffer frames behind, the request is removed and gets an Overflow
+// response instead, which the caller answers by cancelling it on the worker.
+// It reports false when the frame was not delivered, including when the
+// request was sent on another connection.
+func (p *PendingRequests) Deliver(requestId string, conn *net.Conn, response *ResponseManager) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.deliverLocked(requestId, conn, response)
+}
+
+// Resolve delivers the last frame of a response, received on conn, to the
+// waiting request and removes it from the table. It reports false when
+// nobody is waiting for the ID any more, e.g. because the caller timed out
+// or disconnected, or when the request was sent on another connection.
+func (p *PendingRequests) Resolve(requestId string, conn *net.Conn, response *ResponseManager) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.deliverLocked(requestId, conn, response) {
+		return false
+	}
+	delete(p.waiters, requestId)
+	return true
+}
+
+// deliverLocked queues response for requestId without blocking. Senders
+// hold p.mu, so the reserved slot is always free for the failure. Only the
+// worker a request was sent to may answer it.
+func (p *PendingRequests) deliverLocked(requestId string, conn *net.Conn, response *ResponseManager) bool {
+	req, ok := p.waiters[requestId]
+	if !ok || req.conn != conn {
+		return false
+	}
+	if len(req.responses) >= streamBuffer {
+		req.stop()
+		delete(p.waiters, requestId)
+		req.responses <- &ResponseManager{
+			Requestid:  requestId,
+			Response:   []byte("Response not read fast enough"),
+			StatusCode: http.StatusBadGateway,
+			Headers:    map[string][]string{"Content-Type": {"text/plain; charset=utf-8"}},
+			Overflow:   true,
+		}
+		return false
+	}
+	req.responses <- response
+	req.stop()
+	return true
+}
+
+// Grant adds n chunks to the body credit of requestId when it was sent on
+// conn, and reports whether it was.
+func (p *PendingRequests) Grant(requestId string, conn *net.Conn, n int) bool {
+	p.mu.Lock()
+	req, ok := p.waiters[requestId]
+	p.mu.Unlock()
+	if !ok || req.conn != conn || req.credit == nil {
+		return false
+	}
+	req.credit.Grant(n)
+	return true
+}
+
+// Remove drops a request from the table without delivering a response.
+func (p *PendingRequests) Remove(requestId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if req, ok := p.waiters[requestId]; ok {
+		req.stop()
+		delete(p.waiters, requestId)
+	}
+}
+
+// FailConn resolves every request sent on conn with the response built by
+// failure and returns how many requests were failed.
+func (p *PendingRequests) FailConn(conn *net.Conn, failure func(requestId string) *ResponseManager) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failed := 0
+	for id, req := range p.waiters {
+		if req.conn == conn {
+			req.stop()
+			delete(p.waiters, id)
+			req.responses <- failure(id)
+			failed++
+		}
+	}
+	return failed
+}
+
+// Len returns the number of requests currently awaiting a response.
+func (p *PendingRequests) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.waiters)
+}
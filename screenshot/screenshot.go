@@ -3,7 +3,8 @@ package screenshot
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"multichannel/cmd/logging"
 	"strings"
 	"time"
 
@@ -75,12 +76,12 @@ func NewScreenshotManager() *ScreenshotManager {
 	// Create browser context with debug logging
 	ctx, cancel := chromedp.NewContext(
 		allocCtx,
-		chromedp.WithLogf(log.Printf),
+		chromedp.WithLogf(chromeLogf),
 	)
 
 	// Ensure browser is started
 	if err := chromedp.Run(ctx); err != nil {
-		log.Printf("Failed to start browser: %v", err)
+		slog.Error("Failed to start browser", "error", err)
 		baseCancel()
 		cancel()
 		return nil
@@ -143,9 +144,19 @@ func getDeviceSettings(deviceType DeviceType, width, height int64) map[string]in
 
 // CaptureMetrics captures a screenshot and page metrics based on provided options
 func (sm *ScreenshotManager) CaptureMetrics(opts CaptureOptions) (*BrowserMetrics, error) {
+	return sm.CaptureMetricsContext(context.Background(), opts)
+}
+
+// CaptureMetricsContext is like CaptureMetrics, but aborts the capture when
+// parent is cancelled.
+func (sm *ScreenshotManager) CaptureMetricsContext(parent context.Context, opts CaptureOptions) (*BrowserMetrics, error) {
+	start := time.Now()
+	logger := slog.With("url", logging.URL(opts.URL), "device", opts.DeviceType)
 	// Create a timeout context for this capture - increased timeout
 	ctx, cancel := context.WithTimeout(sm.ctx, 120*time.Second)
 	defer cancel()
+	stop := context.AfterFunc(parent, cancel)
+	defer stop()
 
 	// Create options for the browser
 	browserOpts := append(chromedp.DefaultExecAllocatorOptions[:],
@@ -189,7 +200,7 @@ func (sm *ScreenshotManager) CaptureMetrics(opts CaptureOptions) (*BrowserMetric
 	if opts.Width > 0 && opts.Height > 0 {
 		sm.ProgressChan <- Progress{Stage: "viewport", Message: "Setting viewport dimensions..."}
 		if err := chromedp.Run(taskCtx, chromedp.EmulateViewport(opts.Width, opts.Height, chromedp.EmulateScale(opts.Scale))); err != nil {
-			log.Printf("Warning: failed to set viewport: %v", err)
+			logger.Warn("Setting viewport failed", "error", err)
 			// Continue execution even if viewport setting fails
 		}
 	}
@@ -227,7 +238,7 @@ func (sm *ScreenshotManager) CaptureMetrics(opts CaptureOptions) (*BrowserMetric
 		network.Enable(),
 		chromedp.WaitReady("body", chromedp.ByQuery),
 	}); err != nil {
-		log.Printf("Warning: initial page load check failed: %v", err)
+		logger.Warn("Initial page load check failed", "error", err)
 		// Continue anyway as some pages might not trigger ready state properly
 	}
 
@@ -247,7 +258,7 @@ func (sm *ScreenshotManager) CaptureMetrics(opts CaptureOptions) (*BrowserMetric
 		}
 		return nil
 	})); err != nil {
-		log.Printf("Warning: network idle check failed: %v", err)
+		logger.Warn("Network idle check failed", "error", err)
 		// Continue anyway as we might still get a good screenshot
 	}
 
@@ -288,9 +299,16 @@ func (sm *ScreenshotManager) CaptureMetrics(opts CaptureOptions) (*BrowserMetric
 	metrics.NetworkLogs = networkLogs
 	metrics.ConsoleLogs = consoleLogs
 
+	logger.Info("Screenshot captured", "full_page", opts.FullPage, "bytes", len(screenshot),
+		logging.Duration, time.Since(start))
 	return metrics, nil
 }
 
+// chromeLogf passes chromedp's browser logs on at debug level.
+func chromeLogf(format string, args ...interface{}) {
+	slog.Debug(fmt.Sprintf(format, args...), "component", "chromedp")
+}
+
 // Close cleans up resources
 func (sm *ScreenshotManager) Close() {
 	if sm.cancel != nil {
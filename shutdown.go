@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// shutdown stops the gateway without dropping the requests in flight. It
+// stops accepting HTTP requests and worker connections, announces the
+// shutdown to workers with a SHUTDOWN frame and waits up to timeout for the
+// requests being served. Then it stops the gRPC server gracefully and
+// disconnects the workers; requests still running at the deadline fail.
+func shutdown(httpServer *http.Server, grpcServer *grpc.Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	slog.Info("Shutting down", "in_flight", pending.Len(), "timeout", timeout)
+	serverblock.CloseTCP()
+	tcpmanager.Shutdown(deadline)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	// Shutdown closes the listener and idle connections, then waits for
+	// the running handlers, which hold the tunnelled requests
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Warn("Closing requests still in flight", "in_flight", pending.Len(), "error", err)
+		httpServer.Close()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+
+	tcpmanager.DisconnectAll(errGatewayShutdown)
+	slog.Info("Gateway stopped")
+}
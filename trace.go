@@ -0,0 +1,56 @@
+package main
+
+import (
+	"multichannel/cmd/tracing"
+	"multichannel/cmd/typedefs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tracer records the gateway's spans. It is nil unless tracing is
+// configured; trace context sent by callers still reaches the workers then.
+var tracer *tracing.Tracer
+
+// incomingTrace returns the trace context the caller sent, or the zero
+// SpanContext if it sent none or an invalid one.
+func incomingTrace(header http.Header) tracing.SpanContext {
+	sc, _ := tracing.ParseTraceparent(header.Get("Traceparent"), strings.Join(header.Values("Tracestate"), ","))
+	return sc
+}
+
+// propagate makes sc the trace context of the request sent to the worker,
+// both as the Trace field and as the traceparent and tracestate headers.
+func propagate(msg *typedefs.Request, sc tracing.SpanContext) {
+	if !sc.IsValid() {
+		return
+	}
+	msg.Trace = &typedefs.TraceContext{TraceParent: sc.Traceparent(), TraceState: sc.TraceState}
+	msg.Headers["Traceparent"] = []string{msg.Trace.TraceParent}
+	if sc.TraceState != "" {
+		msg.Headers["Tracestate"] = []string{sc.TraceState}
+	}
+}
+
+// endRequestSpan finishes the span covering a whole HTTP request.
+func endRequestSpan(span *tracing.Span, route string, status int) {
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("http.response.status_code", status)
+	if status >= 500 {
+		span.SetError(http.StatusText(status))
+	}
+	span.End()
+}
+
+// recordWireTime annotates the forwarding span when the response head
+// arrives. What remains of it after queueing and the time the worker reports
+// spending is the time frames spent on the wire, both ways.
+func recordWireTime(forward, queue *tracing.Span, worker time.Duration) {
+	if !forward.Recording() {
+		return
+	}
+	forward.SetAttribute("multichannel.worker_ms", worker.Seconds()*1000)
+	if wire := forward.Duration() - queue.Duration() - worker; worker > 0 && wire >= 0 {
+		forward.SetAttribute("multichannel.wire_ms", wire.Seconds()*1000)
+	}
+}
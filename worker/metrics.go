@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"multichannel/cmd/metrics"
+	"net"
+)
+
+// workerMetrics are the metrics a Worker keeps, see Worker.Metrics.
+type workerMetrics struct {
+	registry   *metrics.Registry
+	dials      *metrics.CounterVec
+	reconnects *metrics.Counter
+	registered *metrics.Gauge
+	requests   *metrics.CounterVec
+	duration   *metrics.HistogramVec
+	inFlight   *metrics.Gauge
+	frameBytes *metrics.CounterVec
+}
+
+func newWorkerMetrics(w *Worker) *workerMetrics {
+	r := metrics.NewRegistry()
+	m := &workerMetrics{
+		registry: r,
+		dials: r.NewCounterVec("multichannel_worker_dials_total",
+			"Connection attempts to the gateway, by result: ok or error.", "result"),
+		reconnects: r.NewCounterVec("multichannel_worker_reconnects_total",
+			"Connection attempts after the first one.").With(),
+		registered: r.NewGaugeVec("multichannel_worker_registered",
+			"1 while the worker is registered with the gateway.").With(),
+		requests: r.NewCounterVec("multichannel_worker_requests_total",
+			"Requests handled, by route pattern and status class.", "route", "code"),
+		duration: r.NewHistogramVec("multichannel_worker_callback_duration_seconds",
+			"Time callbacks take to produce a response head.", metrics.DefaultBuckets, "route"),
+		inFlight: r.NewGaugeVec("multichannel_worker_requests_in_flight",
+			"Callbacks running.").With(),
+		frameBytes: r.NewCounterVec("multichannel_worker_frame_bytes_total",
+			"Bytes of TCP frames received from (in) and sent to (out) the gateway.", "direction"),
+	}
+	r.NewGaugeFunc("multichannel_worker_heartbeat_rtt_seconds",
+		"Last heartbeat round trip time to the gateway.", func() float64 {
+			return w.RTT().Seconds()
+		})
+	return m
+}
+
+// meter counts the frame bytes exchanged on conn.
+func (m *workerMetrics) meter(conn net.Conn) net.Conn {
+	return &metrics.Conn{Conn: conn, In: m.frameBytes.With("in"), Out: m.frameBytes.With("out")}
+}
+
+// observe records a request answered with status after the callback ran
+// for seconds.
+func (m *workerMetrics) observe(route string, status int, seconds float64) {
+	if route == "" {
+		route = "unmatched"
+	}
+	m.requests.With(route, metrics.StatusClass(status)).Inc()
+	m.duration.With(route).Observe(seconds)
+}
+
+// Metrics returns the worker's metrics registry: connection attempts and
+// reconnects, registration state, requests and callback latency per route,
+// frame bytes and heartbeat round trip time. It is an http.Handler serving
+// the Prometheus text format:
+//
+//	http.Handle("/metrics", w.Metrics())
+func (w *Worker) Metrics() *metrics.Registry {
+	return w.metrics.registry
+}
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"context"
+	"multichannel/cmd/typedefs"
+	"net"
+	"sync"
+	"time"
+)
+
+// writeTimeout bounds how long a single frame may take to reach the
+// gateway before the connection is considered dead.
+const writeTimeout = 10 * time.Second
+
+// acquire takes a callback slot without waiting. It reports false when
+// maxConcurrency callbacks are already running.
+func (w *Worker) acquire() bool {
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by acquire.
+func (w *Worker) release() {
+	<-w.slots
+}
+
+// syncWriter serialises frame writes from concurrently running callbacks,
+// so each frame reaches the connection in one piece.
+type syncWriter struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (s *syncWriter) Write(frame []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+	return s.conn.Write(frame)
+}
+
+// running tracks the contexts of running callbacks by request ID, and the
+// flow control credit of their streamed responses.
+type running struct {
+	mu       sync.Mutex
+	requests map[string]*runningRequest
+}
+
+type runningRequest struct {
+	cancel context.CancelFunc
+	credit *typedefs.Credit
+}
+
+func newRunning() *running {
+	return &running{requests: make(map[string]*runningRequest)}
+}
+
+// start returns the context for the callback serving requestId. WINDOW
+// grants for its response are added to credit, if not nil.
+func (r *running) start(requestId string, credit *typedefs.Credit) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.requests[requestId] = &runningRequest{cancel: cancel, credit: credit}
+	r.mu.Unlock()
+	return ctx
+}
+
+// finish releases the context of a callback that returned.
+func (r *running) finish(requestId string) {
+	r.mu.Lock()
+	req, ok := r.requests[requestId]
+	delete(r.requests, requestId)
+	r.mu.Unlock()
+	if ok {
+		req.cancel()
+	}
+}
+
+// cancel cancels the callback serving requestId and reports whether one
+// was running.
+func (r *running) cancel(requestId string) bool {
+	r.mu.Lock()
+	req, ok := r.requests[requestId]
+	r.mu.Unlock()
+	if ok {
+		req.cancel()
+	}
+	return ok
+}
+
+// grant adds n chunks to the response credit of requestId and reports
+// whether its callback is running with flow control.
+func (r *running) grant(requestId string, n int) bool {
+	r.mu.Lock()
+	req, ok := r.requests[requestId]
+	r.mu.Unlock()
+	if !ok || req.credit == nil {
+		return false
+	}
+	req.credit.Grant(n)
+	return true
+}
+
+// cancelAll cancels every running callback.
+func (r *running) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, req := range r.requests {
+		req.cancel()
+	}
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"multichannel/cmd/messages"
+	grpcclient "multichannel/grpc/client"
+	"net/http"
+)
+
+// RegisterHTTP announces the worker's client ID and paths on the gateway's
+// HTTP /register endpoint.
+func (w *Worker) RegisterHTTP() error {
+	request := messages.RegisterRequest{
+		ClientId: w.clientId,
+		Paths:    w.paths,
+	}
+	url := fmt.Sprintf("http://%s:%d/register", w.host, w.httpPort)
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON: %v", err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	w.logger.Info("Registered over HTTP", "url", url, "status", resp.Status)
+	response := messages.RegisterResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
+
+// RegisterGRPC registers the worker through the gateway's gRPC service.
+func (w *Worker) RegisterGRPC() error {
+	grpcClient, err := grpcclient.NewRegisterClient(fmt.Sprintf("%s:%d", w.host, w.grpcPort), w.tlsClientConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create gRPC client: %v", err)
+	}
+	defer grpcClient.Close()
+
+	resp, err := grpcClient.Register(w.clientId, "test@example.com", "password123")
+	if err != nil {
+		return fmt.Errorf("failed to register via gRPC: %v", err)
+	}
+
+	w.logger.Info("Registered over gRPC", "success", resp.Success, "message", resp.Message, "user_id", resp.UserId)
+	return nil
+}
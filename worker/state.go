@@ -0,0 +1,58 @@
+package worker
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ConnState is the state of the worker's TCP connection to the gateway.
+type ConnState string
+
+const (
+	StateConnecting   ConnState = "connecting"
+	StateConnected    ConnState = "connected"  // TCP connected, registration pending
+	StateRegistered   ConnState = "registered" // serving requests
+	StateDisconnected ConnState = "disconnected"
+)
+
+// setState records a connection state transition and reports it to the
+// WithStateChange function.
+func (w *Worker) setState(state ConnState) {
+	w.stateMu.Lock()
+	previous := w.state
+	w.state = state
+	w.stateMu.Unlock()
+	if previous == state {
+		return
+	}
+	w.logger.Debug("Connection state changed", "from", previous, "to", state)
+	if state == StateRegistered {
+		w.metrics.registered.Set(1)
+	} else {
+		w.metrics.registered.Set(0)
+	}
+	if w.onStateChange != nil {
+		w.onStateChange(previous, state)
+	}
+}
+
+// State returns the current connection state.
+func (w *Worker) State() ConnState {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	return w.state
+}
+
+// backoff returns how long to wait before reconnect attempt n (starting at
+// 0): exponential growth from reconnectMin capped at reconnectMax, with the
+// upper half randomised so a fleet of workers does not reconnect in lockstep.
+func (w *Worker) backoff(attempt int) time.Duration {
+	delay := w.reconnectMax
+	if attempt < 32 {
+		if d := w.reconnectMin << uint(attempt); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
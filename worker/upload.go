@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"errors"
+	"io"
+	"multichannel/cmd/typedefs"
+	"sync/atomic"
+)
+
+// errUploadOverflow fails requests whose body arrives faster than the
+// callback reads it, beyond the flow control window.
+var errUploadOverflow = errors.New("request body not read fast enough")
+
+// upload carries the streamed body of a request from the read loop to the
+// callback. Writes never wait, so a callback that reads slowly or not at all
+// cannot hold up the connection: chunks are queued up to the flow control
+// window and Write fails once a gateway sends more than it was granted.
+type upload struct {
+	chunks    chan []byte
+	err       error // returned once chunks is drained, set before it is closed
+	pending   []byte
+	onRead    func() // called for every chunk the callback takes
+	abandoned atomic.Bool
+}
+
+func newUpload(onRead func()) *upload {
+	return &upload{
+		chunks: make(chan []byte, typedefs.StreamWindow),
+		err:    io.EOF,
+		onRead: onRead,
+	}
+}
+
+// Write queues a chunk and reports false when the queue is full. Chunks of
+// an upload the callback closed are discarded.
+func (u *upload) Write(chunk []byte) bool {
+	if u.abandoned.Load() {
+		return true
+	}
+	select {
+	case u.chunks <- append([]byte(nil), chunk...):
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseWithError ends the body: Read returns err, or io.EOF if err is nil,
+// after the queued chunks. It must be called once, by the read loop.
+func (u *upload) CloseWithError(err error) {
+	if err != nil {
+		u.err = err
+	}
+	close(u.chunks)
+}
+
+func (u *upload) Read(p []byte) (int, error) {
+	for len(u.pending) == 0 {
+		chunk, ok := <-u.chunks
+		if !ok {
+			return 0, u.err
+		}
+		u.pending = chunk
+		if u.onRead != nil {
+			u.onRead()
+		}
+	}
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+	return n, nil
+}
+
+// Close tells the read loop the callback is done with the body.
+func (u *upload) Close() error {
+	u.abandoned.Store(true)
+	return nil
+}
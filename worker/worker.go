@@ -0,0 +1,777 @@
+// Package worker connects a process to the multichannel gateway over TCP and
+// serves the HTTP requests the gateway routes to it.
+//
+//	w := worker.New(worker.WithHost("localhost"), worker.WithTCPPort(8081))
+//	w.Handle("/stocks", stocksCallback)
+//	if err := w.Run(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"multichannel/cmd/callbacks"
+	"multichannel/cmd/logging"
+	"multichannel/cmd/tracing"
+	"multichannel/cmd/typedefs"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Worker serves callbacks for the paths it registers with the gateway.
+type Worker struct {
+	host     string
+	httpPort int
+	tcpPort  int
+	grpcPort int
+	clientId string
+	paths    []string
+	registry *callbacks.CallbackRegistry
+
+	heartbeatInterval time.Duration
+	heartbeatMisses   int
+	rtt               atomic.Int64 // last heartbeat round trip in nanoseconds
+	maxFrameSize      int
+	codec             string // preferred wire codec
+
+	authKeyID  string // credential name in the gateway's auth policy
+	authToken  string
+	authSecret []byte
+	tlsConfig  *tls.Config
+	tracer     *tracing.Tracer
+
+	reconnectMin  time.Duration
+	reconnectMax  time.Duration
+	onStateChange func(from, to ConnState)
+	stateMu       sync.Mutex
+	state         ConnState
+
+	maxConcurrency int
+	slots          chan struct{} // one token per running callback
+
+	metrics *workerMetrics
+	logger  *slog.Logger
+
+	drainTimeout time.Duration  // wait for DRAINED on shutdown
+	inflight     sync.WaitGroup // callbacks still running
+	shutdownMu   sync.Mutex
+	shuttingDown bool
+}
+
+// Option configures a Worker.
+type Option func(*Worker)
+
+// WithHost sets the gateway host. The default is localhost.
+func WithHost(host string) Option {
+	return func(w *Worker) { w.host = host }
+}
+
+// WithHTTPPort sets the gateway HTTP port used by RegisterHTTP.
+func WithHTTPPort(port int) Option {
+	return func(w *Worker) { w.httpPort = port }
+}
+
+// WithTCPPort sets the gateway TCP port requests are tunnelled over.
+func WithTCPPort(port int) Option {
+	return func(w *Worker) { w.tcpPort = port }
+}
+
+// WithGRPCPort sets the gateway gRPC port used by RegisterGRPC.
+func WithGRPCPort(port int) Option {
+	return func(w *Worker) { w.grpcPort = port }
+}
+
+// WithClientID sets the client ID sent in REG. A random UUID is used by
+// default; it stays the same across reconnects.
+func WithClientID(id string) Option {
+	return func(w *Worker) { w.clientId = id }
+}
+
+// WithPaths registers paths with the gateway in addition to those added by
+// Handle.
+func WithPaths(paths ...string) Option {
+	return func(w *Worker) { w.addPaths(paths...) }
+}
+
+// WithHeartbeat sets the heartbeat interval and how many silent intervals
+// are tolerated before the connection is dropped. A zero interval disables
+// heartbeats.
+func WithHeartbeat(interval time.Duration, misses int) Option {
+	return func(w *Worker) {
+		w.heartbeatInterval = interval
+		w.heartbeatMisses = misses
+	}
+}
+
+// WithMaxFrameSize limits the size of frames accepted from the gateway. The
+// default is typedefs.DefaultMaxFrameSize.
+func WithMaxFrameSize(n int) Option {
+	return func(w *Worker) { w.maxFrameSize = n }
+}
+
+// WithCodec sets the codec the worker asks for in REG when the gateway
+// offers it; JSON is used otherwise. The default is "protobuf".
+func WithCodec(name string) Option {
+	return func(w *Worker) { w.codec = name }
+}
+
+// WithMaxConcurrency limits how many callbacks run at once. The limit is
+// advertised in REG so the gateway stops routing to a saturated worker;
+// requests beyond it are answered with 503. The default is 16.
+func WithMaxConcurrency(n int) Option {
+	return func(w *Worker) { w.maxConcurrency = n }
+}
+
+// WithToken authenticates the worker with a pre-shared token from the
+// gateway's auth policy.
+func WithToken(token string) Option {
+	return func(w *Worker) { w.authToken = token }
+}
+
+// WithHMAC authenticates the worker by signing the gateway's WELCOME
+// challenge with the secret of the policy credential keyID. The secret
+// itself never travels over the connection.
+func WithHMAC(keyID string, secret []byte) Option {
+	return func(w *Worker) {
+		w.authKeyID = keyID
+		w.authSecret = secret
+	}
+}
+
+// WithTLS connects to the gateway's TCP and gRPC listeners over TLS. The
+// server name defaults to the gateway host; a client certificate in config
+// identifies the worker to gateways that verify them. See
+// tlsconfig.Reloader.ClientConfig for certificates rotated on disk.
+func WithTLS(config *tls.Config) Option {
+	return func(w *Worker) { w.tlsConfig = config }
+}
+
+// WithTracer records a span around every callback, as a child of the
+// gateway's forwarding span. Callbacks see the span's context in
+// Request.Trace and the Traceparent header, to pass on downstream.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(w *Worker) { w.tracer = tracer }
+}
+
+// WithLogger sets the logger the worker writes to; its records carry the
+// client ID and, for requests, the request ID and path. The default is
+// slog.Default() as of New.
+func WithLogger(logger *slog.Logger) Option {
+	return func(w *Worker) { w.logger = logger }
+}
+
+// WithDrainTimeout sets how long Run waits on cancellation for the gateway
+// to confirm with DRAINED that it routes no more requests to the worker,
+// before it refuses new requests. The default is 30 seconds.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(w *Worker) { w.drainTimeout = d }
+}
+
+// WithReconnect sets the first and the largest delay between reconnect
+// attempts.
+func WithReconnect(min, max time.Duration) Option {
+	return func(w *Worker) {
+		w.reconnectMin = min
+		w.reconnectMax = max
+	}
+}
+
+// WithStateChange sets a function called on every connection state
+// transition, e.g. to report readiness.
+func WithStateChange(fn func(from, to ConnState)) Option {
+	return func(w *Worker) { w.onStateChange = fn }
+}
+
+// New creates a Worker with the given options.
+func New(opts ...Option) *Worker {
+	w := &Worker{
+		host:              "localhost",
+		httpPort:          8080,
+		tcpPort:           8081,
+		grpcPort:          50051,
+		clientId:          uuid.New().String(),
+		registry:          callbacks.NewCallbackRegistry(),
+		heartbeatInterval: 15 * time.Second,
+		heartbeatMisses:   3,
+		maxFrameSize:      typedefs.DefaultMaxFrameSize,
+		codec:             typedefs.ProtobufCodec.Name(),
+		maxConcurrency:    16,
+		reconnectMin:      500 * time.Millisecond,
+		reconnectMax:      30 * time.Second,
+		drainTimeout:      30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.maxConcurrency < 1 {
+		w.maxConcurrency = 1
+	}
+	w.slots = make(chan struct{}, w.maxConcurrency)
+	w.metrics = newWorkerMetrics(w)
+	if w.logger == nil {
+		w.logger = slog.Default()
+	}
+	w.logger = w.logger.With(logging.ClientID, w.clientId)
+	return w
+}
+
+// Handle registers handler for a route pattern such as "/stocks",
+// "GET /stocks/{symbol}" or "/static/*" (see typedefs.Route). It must be
+// called before Run and panics if the pattern is invalid.
+func (w *Worker) Handle(pattern string, handler callbacks.Callback) {
+	if err := w.registry.Register(pattern, handler); err != nil {
+		panic(err)
+	}
+	w.addPaths(pattern)
+}
+
+// HandleHTTP serves a route pattern with a standard http.Handler, see
+// callbacks.HTTPHandler. Mount a router under a prefix pattern such as
+// "/api/*"; it receives the original request path.
+func (w *Worker) HandleHTTP(pattern string, handler http.Handler) {
+	w.Handle(pattern, callbacks.HTTPHandler(handler))
+}
+
+func (w *Worker) addPaths(paths ...string) {
+	for _, path := range paths {
+		known := false
+		for _, p := range w.paths {
+			if p == path {
+				known = true
+				break
+			}
+		}
+		if !known {
+			w.paths = append(w.paths, path)
+		}
+	}
+}
+
+// ClientID returns the client ID the worker registers with.
+func (w *Worker) ClientID() string {
+	return w.clientId
+}
+
+// Paths returns the paths the worker registers with the gateway.
+func (w *Worker) Paths() []string {
+	return append([]string(nil), w.paths...)
+}
+
+// RTT returns the last measured heartbeat round trip time to the server.
+func (w *Worker) RTT() time.Duration {
+	return time.Duration(w.rtt.Load())
+}
+
+// Run keeps the worker connected to the gateway until ctx is cancelled.
+// Whenever the connection drops it reconnects with exponential backoff and
+// jitter, and registers again with the same client ID. On cancellation it
+// drains: it sends DRAIN so the gateway routes it no more requests, serves
+// those already routed until the gateway answers DRAINED (or the drain
+// timeout passes), waits for running callbacks to finish and returns nil.
+// When the gateway rejects the registration for good, e.g. for a wrong
+// credential, Run stops with the *typedefs.Rejection; it also stops when
+// the gateway's WELCOME message is malformed.
+func (w *Worker) Run(ctx context.Context) error {
+	address := fmt.Sprintf("%s:%d", w.host, w.tcpPort)
+
+	var dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	} = &net.Dialer{}
+	if tlsConfig := w.tlsClientConfig(); tlsConfig != nil {
+		dialer = &tls.Dialer{Config: tlsConfig}
+	}
+	attempt := 0
+	for dials := 0; ; dials++ {
+		if dials > 0 {
+			w.metrics.reconnects.Inc()
+		}
+		w.setState(StateConnecting)
+		w.logger.Debug("Dialing gateway", "addr", address)
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			w.metrics.dials.With("error").Inc()
+			w.logger.Warn("Connecting to gateway failed", "addr", address, "error", err)
+		} else {
+			w.metrics.dials.With("ok").Inc()
+			w.logger.Info("Connected to gateway", "addr", address)
+			w.setState(StateConnected)
+			registered, err := w.serve(ctx, conn)
+			w.setState(StateDisconnected)
+			if err != nil {
+				return err
+			}
+			if registered {
+				attempt = 0
+			}
+		}
+		if ctx.Err() != nil {
+			w.drain()
+			return nil
+		}
+
+		delay := w.backoff(attempt)
+		attempt++
+		w.logger.Info("Reconnecting", "delay", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			w.drain()
+			return nil
+		}
+	}
+}
+
+// tlsClientConfig returns the TLS configuration for the gateway, or nil for
+// plaintext.
+func (w *Worker) tlsClientConfig() *tls.Config {
+	if w.tlsConfig == nil {
+		return nil
+	}
+	config := w.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = w.host
+	}
+	return config
+}
+
+// reg sends the REG frame announcing the worker's client ID, paths, the
+// codec it will write with, its concurrency limit, its credential and
+// whether it accepts the flow control the gateway offered.
+func (w *Worker) reg(writer *typedefs.TcpMessageWriter, codec typedefs.Codec, challenge string, flow bool) error {
+	reg := map[string]interface{}{
+		"client_id":       w.clientId,
+		"Paths":           w.paths,
+		"codec":           codec.Name(),
+		"max_concurrency": w.maxConcurrency,
+	}
+	if flow {
+		reg["flow_control"] = true
+	}
+	switch {
+	case w.authSecret != nil:
+		reg["auth"] = typedefs.Auth{
+			KeyID:     w.authKeyID,
+			Signature: typedefs.SignChallenge(w.authSecret, challenge, w.clientId),
+		}
+	case w.authToken != "":
+		reg["auth"] = typedefs.Auth{KeyID: w.authKeyID, Token: w.authToken}
+	}
+	payload, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	msg := typedefs.TcpMessage{
+		Sub: "REG",
+		Msg: payload,
+	}
+
+	err = writer.WriteMessage(&msg)
+	if err != nil {
+		w.logger.Warn("Sending registration failed", "error", err)
+		return err
+	}
+	w.logger.Debug("Registration sent", "paths", w.paths)
+	return nil
+}
+
+// serve registers on conn and handles server messages until the connection
+// fails or ctx is cancelled. It reports whether registration succeeded, and
+// returns an error only for rejections that reconnecting cannot fix.
+func (w *Worker) serve(ctx context.Context, conn net.Conn) (registered bool, err error) {
+	defer conn.Close()
+	conn = w.metrics.meter(conn)
+	reader := typedefs.NewTcpMessageReader(conn)
+	reader.SetMaxFrameSize(w.maxFrameSize)
+	// Callbacks answer concurrently; syncWriter keeps their frames whole
+	writer := typedefs.NewTcpMessageWriter(&syncWriter{conn: conn, timeout: writeTimeout})
+
+	// Read welcome message
+	welcome, err := reader.ReadMessage()
+	if err != nil {
+		w.logger.Warn("Reading welcome message failed", "error", err)
+		return false, nil
+	}
+	w.logger.Debug("Received welcome message", "type", welcome.Sub, "message", string(welcome.Msg))
+
+	// Send registration message, then switch to the negotiated codec. The
+	// gateway reads the codec of each frame from its header.
+	codec := typedefs.NegotiateCodec(welcome.Msg, w.codec)
+	var hello typedefs.Welcome
+	if err := json.Unmarshal(welcome.Msg, &hello); err != nil {
+		return false, fmt.Errorf("welcome: %w", err)
+	}
+	flow := hello.FlowControl
+	if err := w.reg(writer, codec, hello.Challenge, flow); err != nil {
+		return false, nil
+	}
+	writer.SetCodec(codec)
+	w.logger.Debug("Negotiated codec", "codec", codec.Name())
+
+	// Bodies of streamed requests that are still being received
+	uploads := make(map[string]*upload)
+	// Running callbacks, so CANCEL frames and a lost connection stop them
+	running := newRunning()
+	defer running.cancelAll()
+
+	var lastSeen atomic.Int64
+	lastSeen.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	defer close(done)
+	if w.heartbeatInterval > 0 {
+		go w.keepalive(conn, writer, &lastSeen, done)
+	}
+
+	// On shutdown, ask the gateway to stop routing requests here, then
+	// refuse new ones and close the connection once the running callbacks
+	// have written their responses.
+	var ready atomic.Bool // registered, so the gateway may route requests here
+	drained := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ready.Load() {
+				w.awaitDrained(writer, drained, done)
+			}
+			w.drain()
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// Handle server messages
+	for {
+		response, err := reader.ReadMessage()
+		if err != nil {
+			if err == io.EOF {
+				w.logger.Info("Connection closed by gateway")
+			} else if ctx.Err() == nil {
+				w.logger.Warn("Reading from gateway failed", "error", err)
+			}
+			// Release callbacks still waiting for streamed request bodies
+			for _, body := range uploads {
+				body.CloseWithError(err)
+			}
+			return registered, nil
+		}
+		lastSeen.Store(time.Now().UnixNano())
+		if w.logger.Enabled(ctx, slog.LevelDebug) {
+			w.logger.Debug("Received frame", "type", response.Sub, logging.RequestID, response.RequestId)
+		}
+
+		switch response.Sub {
+		case "REQUEST":
+			request, err := response.DecodeRequest()
+			if err != nil {
+				w.logger.Warn("Invalid request", logging.RequestID, response.RequestId, "error", err)
+				continue
+			}
+			if !w.begin() {
+				w.logger.Info("Refusing request while shutting down", logging.RequestID, request.RequestId)
+				w.fail(writer, request.RequestId, http.StatusServiceUnavailable, errors.New("worker is shutting down"))
+				continue
+			}
+			if !w.acquire() {
+				w.inflight.Done()
+				w.logger.Warn("Refusing request at capacity", logging.RequestID, request.RequestId,
+					"max_concurrency", w.maxConcurrency)
+				w.fail(writer, request.RequestId, http.StatusServiceUnavailable, errors.New("worker is at capacity"))
+				continue
+			}
+
+			// Callbacks run in their own goroutine so a slow path does not
+			// hold up the others. A streamed body follows as REQUEST_CHUNK
+			// frames, which this loop queues for the callback, granting the
+			// gateway a new chunk for every one the callback takes.
+			var body *upload
+			if request.Stream {
+				var onRead func()
+				if flow {
+					var receipts typedefs.Receipts
+					requestId := request.RequestId
+					onRead = func() {
+						if n := receipts.Consume(); n > 0 {
+							if err := writer.WriteMessage(typedefs.NewWindow(requestId, n)); err != nil {
+								w.logger.Warn("Granting request window failed", logging.RequestID, requestId, "error", err)
+							}
+						}
+					}
+				}
+				body = newUpload(onRead)
+				uploads[request.RequestId] = body
+				request.BodyReader = body
+			} else {
+				request.BodyReader = bytes.NewReader(request.Body)
+			}
+			var credit *typedefs.Credit
+			if flow {
+				credit = typedefs.NewCredit()
+			}
+			ctx := running.start(request.RequestId, credit)
+			w.metrics.inFlight.Inc()
+			go func() {
+				defer w.inflight.Done()
+				defer w.metrics.inFlight.Dec()
+				defer w.release()
+				defer running.finish(request.RequestId)
+				w.respond(ctx, writer, *request, credit)
+				if body != nil {
+					body.Close()
+				}
+			}()
+		case "REQUEST_CHUNK":
+			body, ok := uploads[response.RequestId]
+			if ok && !body.Write(response.Msg) {
+				// The gateway sent more than it was granted; give up on
+				// the request rather than wait for the callback
+				w.logger.Warn("Request body not read fast enough, cancelling request", logging.RequestID, response.RequestId)
+				running.cancel(response.RequestId)
+				body.CloseWithError(errUploadOverflow)
+				delete(uploads, response.RequestId)
+				w.fail(writer, response.RequestId, http.StatusServiceUnavailable, errUploadOverflow)
+			}
+		case "END":
+			if body, ok := uploads[response.RequestId]; ok {
+				body.CloseWithError(nil)
+				delete(uploads, response.RequestId)
+			}
+		case "CANCEL":
+			// The caller went away; stop the callback and its upload
+			if running.cancel(response.RequestId) {
+				w.logger.Info("Request cancelled by gateway", logging.RequestID, response.RequestId)
+			}
+			if body, ok := uploads[response.RequestId]; ok {
+				body.CloseWithError(context.Canceled)
+				delete(uploads, response.RequestId)
+			}
+		case "HEARTBEAT":
+			if err := writer.WriteMessage(typedefs.NewHeartbeatResponse(response)); err != nil {
+				w.logger.Warn("Answering heartbeat failed", "error", err)
+			}
+		case "HEARTBEAT_RESPONSE":
+			rtt, err := typedefs.HeartbeatRTT(response)
+			if err != nil {
+				w.logger.Warn("Invalid heartbeat response", "error", err)
+				continue
+			}
+			w.rtt.Store(int64(rtt))
+		case "WINDOW":
+			n, err := typedefs.WindowSize(response)
+			if err != nil {
+				w.logger.Warn("Invalid window", logging.RequestID, response.RequestId, "error", err)
+				continue
+			}
+			running.grant(response.RequestId, n)
+		case "DRAINED":
+			// No requests follow; the running ones finish before conn closes
+			select {
+			case <-drained:
+			default:
+				close(drained)
+			}
+		case "SHUTDOWN":
+			var notice typedefs.Shutdown
+			json.Unmarshal(response.Msg, &notice)
+			w.logger.Info("Gateway shutting down, finishing running requests", "deadline", notice.Deadline)
+		case "REG_RESPONSE":
+			w.logger.Info("Registered with gateway", "paths", w.paths)
+			registered = true
+			ready.Store(true)
+			w.setState(StateRegistered)
+		case "REG_REJECTED":
+			var rejection typedefs.Rejection
+			if err := json.Unmarshal(response.Msg, &rejection); err != nil {
+				rejection = typedefs.Rejection{Reason: string(response.Msg)}
+			}
+			w.logger.Error("Gateway rejected registration", "code", rejection.Code, "reason", rejection.Reason)
+			if rejection.Temporary() {
+				return false, nil
+			}
+			return false, &rejection
+		default:
+			w.logger.Warn("Unknown message type", "type", response.Sub)
+		}
+	}
+}
+
+// begin accounts for a callback about to run. It reports false once the
+// worker is shutting down and no longer accepts requests.
+func (w *Worker) begin() bool {
+	w.shutdownMu.Lock()
+	defer w.shutdownMu.Unlock()
+	if w.shuttingDown {
+		return false
+	}
+	w.inflight.Add(1)
+	return true
+}
+
+// drain stops accepting requests and waits for running callbacks.
+func (w *Worker) drain() {
+	w.shutdownMu.Lock()
+	w.shuttingDown = true
+	w.shutdownMu.Unlock()
+	w.inflight.Wait()
+}
+
+// awaitDrained sends DRAIN and waits until the gateway answers DRAINED,
+// the drain timeout passes or the connection drops. Requests keep being
+// served meanwhile.
+func (w *Worker) awaitDrained(writer *typedefs.TcpMessageWriter, drained, done <-chan struct{}) {
+	w.logger.Info("Draining", "timeout", w.drainTimeout)
+	if err := writer.WriteMessage(typedefs.NewDrain()); err != nil {
+		w.logger.Warn("Sending drain request failed", "error", err)
+		return
+	}
+	timer := time.NewTimer(w.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		w.logger.Info("Drained by gateway")
+	case <-timer.C:
+		w.logger.Warn("Gateway did not confirm drain, refusing new requests", "timeout", w.drainTimeout)
+	case <-done:
+	}
+}
+
+// keepalive sends heartbeats to the server and closes conn once nothing has
+// been received for heartbeatMisses intervals, which ends the read loop in
+// serve.
+func (w *Worker) keepalive(conn net.Conn, writer *typedefs.TcpMessageWriter, lastSeen *atomic.Int64, done <-chan struct{}) {
+	ticker := time.NewTicker(w.heartbeatInterval)
+	defer ticker.Stop()
+	limit := w.heartbeatInterval * time.Duration(w.heartbeatMisses)
+	for {
+		if err := writer.WriteMessage(typedefs.NewHeartbeat()); err != nil {
+			w.logger.Warn("Sending heartbeat failed", "error", err)
+			conn.Close()
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if silence := time.Since(time.Unix(0, lastSeen.Load())); silence > limit {
+			w.logger.Warn("Gateway silent, closing connection", "silence", silence.Round(time.Second))
+			conn.Close()
+			return
+		}
+	}
+}
+
+// respond runs the callback for request and writes its result back as a
+// RESPONSE frame, a streamed RESPONSE followed by RESPONSE_CHUNK frames, or an
+// ERROR frame. Nothing is sent for a request cancelled by the gateway.
+func (w *Worker) respond(ctx context.Context, writer *typedefs.TcpMessageWriter, request typedefs.Request, credit *typedefs.Credit) {
+	span := w.startSpan(&request)
+	defer span.End()
+	logger := w.logger.With(logging.RequestID, request.RequestId, logging.Path, request.Path)
+	if id := request.Headers.Get(typedefs.RequestIDHeader); id != "" && id != request.RequestId {
+		logger = logger.With(logging.CorrelationID, id)
+	}
+	logger.Debug("Request received", "method", request.Method, "route", request.Route,
+		logging.RemoteAddr, request.RemoteAddr, logging.Headers(request.Headers))
+
+	start := time.Now()
+	result, err := w.registry.Handle(ctx, request)
+	elapsed := time.Since(start)
+	if ctx.Err() != nil {
+		span.SetError("cancelled by gateway")
+		if err == nil && result.BodyReader != nil {
+			if closer, ok := result.BodyReader.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+		w.metrics.observe(request.Route, 499, elapsed.Seconds())
+		logger.Info("Dropping response to cancelled request", logging.Duration, elapsed)
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, callbacks.ErrCallbackNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, typedefs.ErrMethodNotAllowed):
+			status = http.StatusMethodNotAllowed
+		}
+		w.metrics.observe(request.Route, status, elapsed.Seconds())
+		span.SetAttribute("http.response.status_code", status)
+		span.SetError(err.Error())
+		logger.Warn("Callback failed", "status", status, logging.Duration, elapsed, "error", err)
+		w.fail(writer, request.RequestId, status, err)
+		return
+	}
+	w.metrics.observe(request.Route, int(result.StatusCode), elapsed.Seconds())
+	span.SetAttribute("http.response.status_code", int(result.StatusCode))
+	if result.StatusCode >= 500 {
+		span.SetError(http.StatusText(int(result.StatusCode)))
+	}
+	result.Duration = elapsed
+
+	bodyReader := result.BodyReader
+	if bodyReader != nil {
+		if closer, ok := bodyReader.(io.Closer); ok {
+			defer closer.Close()
+		}
+		result.Stream = true
+	}
+	if err := writer.WriteResponse("RESPONSE", request.RequestId, result); err != nil {
+		logger.Warn("Writing response failed", "error", err)
+		return
+	}
+	if bodyReader != nil {
+		err := writer.WriteStreamCredit(request.RequestId, "RESPONSE_CHUNK", bodyReader, credit, ctx.Done())
+		if errors.Is(err, typedefs.ErrStreamStopped) {
+			logger.Info("Response stream cancelled by gateway", logging.Duration, time.Since(start))
+			return
+		}
+		if err != nil {
+			logger.Warn("Streaming response failed", "error", err)
+		}
+	}
+	logger.Info("Request handled", "status", result.StatusCode, "stream", result.Stream,
+		logging.Duration, time.Since(start))
+}
+
+// fail answers a request with an ERROR frame.
+func (w *Worker) fail(writer *typedefs.TcpMessageWriter, requestId string, status int, err error) {
+	if err := writer.WriteResponse("ERROR", requestId, typedefs.NewErrorResponse(status, err)); err != nil {
+		w.logger.Warn("Writing error response failed", logging.RequestID, requestId, "error", err)
+	}
+}
+
+// startSpan starts the callback span of request and makes it the trace
+// context the callback sees. Without a tracer the gateway's context is left
+// as it is.
+func (w *Worker) startSpan(request *typedefs.Request) *tracing.Span {
+	var parent tracing.SpanContext
+	if request.Trace != nil {
+		parent, _ = tracing.ParseTraceparent(request.Trace.TraceParent, request.Trace.TraceState)
+	}
+	span := w.tracer.Start(parent, "worker.callback", tracing.SpanKindServer)
+	span.SetAttribute("http.request.method", request.Method)
+	span.SetAttribute("http.route", request.Route)
+	span.SetAttribute("multichannel.client_id", w.clientId)
+	if sc := span.Context(); span.Recording() {
+		request.Trace = &typedefs.TraceContext{TraceParent: sc.Traceparent(), TraceState: sc.TraceState}
+		headers := make(typedefs.Headers, len(request.Headers)+1)
+		for key, values := range request.Headers {
+			headers[key] = values
+		}
+		headers["Traceparent"] = []string{request.Trace.TraceParent}
+		request.Headers = headers
+	}
+	return span
+}